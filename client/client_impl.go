@@ -2,36 +2,40 @@ package client
 
 import (
 	"bufio"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/wenyinh/18749-project/protocol"
 	"github.com/wenyinh/18749-project/utils"
 )
 
-type RequestMessage struct {
-	Type       string `json:"type"`
-	ClientID   string `json:"client_id"`
-	RequestNum int    `json:"request_num"`
-	Message    string `json:"message"`
-}
+const (
+	subscribe = "SUBSCRIBE"
+	primary   = "PRIMARY"
 
-type ResponseMessage struct {
-	Type        string `json:"type"`
-	ServerID    string `json:"server_id"`
-	ClientID    string `json:"client_id"`
-	RequestNum  int    `json:"request_num"`
-	ServerState int    `json:"server_state"`
-	Message     string `json:"message"`
-}
+	// helloTimeout bounds the wait for a replica's answer to HELLO
+	helloTimeout = 3 * time.Second
+)
+
+// Mode selects which replicas receive each request: only the primary (passive)
+// or every replica (active)
+type Mode int
+
+const (
+	Passive Mode = iota
+	Active
+)
 
 type QueuedRequest struct {
 	RequestNum int
 	Message    string
 	Timestamp  time.Time
+	Sent       bool // Reached a replica before its reply was lost, so it may have been applied
 }
 
 type ReplicaConnection struct {
@@ -40,16 +44,20 @@ type ReplicaConnection struct {
 	Conn            net.Conn
 	IsHealthy       bool
 	Queue           []QueuedRequest
+	inflight        map[int]QueuedRequest // Sent and awaiting a reply, by request number
 	mu              sync.Mutex
 	reader          *bufio.Reader
-	reconnecting    bool // Flag to prevent multiple reconnection attempts
-	permanentlyDown bool // Flag to mark replica as permanently unreachable
+	reconnecting    bool               // Flag to prevent multiple reconnection attempts
+	permanentlyDown bool               // Flag to mark replica as permanently unreachable
+	proto           protocol.Handshake // Version and capabilities agreed with the replica
 }
 
 type client struct {
 	clientID       string
 	replicas       []*ReplicaConnection
 	primaryID      string
+	rmAddr         string // RM address for primary updates ("" = fixed primary)
+	mode           Mode
 	requestNum     int
 	maxQueueSize   int
 	maxRetries     int
@@ -59,7 +67,7 @@ type client struct {
 	replyMu        sync.Mutex
 }
 
-func NewClient(clientID string, serverAddrs map[string]string, primaryID string) Client {
+func NewClient(clientID string, serverAddrs map[string]string, primaryID, rmAddr string, mode Mode) Client {
 	replicas := make([]*ReplicaConnection, 0, len(serverAddrs))
 	for serverID, addr := range serverAddrs {
 		replicas = append(replicas, &ReplicaConnection{
@@ -67,6 +75,7 @@ func NewClient(clientID string, serverAddrs map[string]string, primaryID string)
 			Addr:      addr,
 			IsHealthy: false,
 			Queue:     make([]QueuedRequest, 0),
+			inflight:  make(map[int]QueuedRequest),
 		})
 	}
 
@@ -74,6 +83,8 @@ func NewClient(clientID string, serverAddrs map[string]string, primaryID string)
 		clientID:       clientID,
 		replicas:       replicas,
 		primaryID:      primaryID,
+		rmAddr:         rmAddr,
+		mode:           mode,
 		requestNum:     0,
 		maxQueueSize:   100,
 		maxRetries:     5,
@@ -106,6 +117,10 @@ func (c *client) Connect() error {
 
 	wg.Wait()
 
+	if c.rmAddr != "" {
+		go c.watchPrimary()
+	}
+
 	// Check if at least one replica is connected
 	hasConnection := false
 	for _, replica := range c.replicas {
@@ -126,18 +141,64 @@ func (c *client) connectReplica(replica *ReplicaConnection) error {
 	replica.mu.Lock()
 	defer replica.mu.Unlock()
 
-	conn, err := net.Dial("tcp", replica.Addr)
+	conn, err := utils.Dial(replica.Addr, 0)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	proto, err := c.hello(replica.ServerID, conn, reader)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 
 	replica.Conn = conn
-	replica.reader = bufio.NewReader(conn)
+	replica.reader = reader
+	replica.proto = proto
 	replica.IsHealthy = true
 	replica.permanentlyDown = false
 	return nil
 }
 
+// hello agrees on a protocol version with a freshly connected replica. A
+// replica that predates HELLO answers with an error line and speaks version 1.
+func (c *client) hello(serverID string, conn net.Conn, reader *bufio.Reader) (protocol.Handshake, error) {
+	if err := protocol.Send(conn, c.clientID, 0, protocol.Hello{Handshake: protocol.Offer()}); err != nil {
+		return protocol.Handshake{}, err
+	}
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	reply, err := utils.ReadLine(reader)
+	if err != nil {
+		return protocol.Handshake{}, err
+	}
+	env, err := protocol.Decode(reply)
+	if err != nil {
+		log.Printf("[%s→%s] Replica does not support HELLO, assuming protocol v1", c.clientID, serverID)
+		return protocol.Handshake{Version: 1}, nil
+	}
+	switch env.Type {
+	case protocol.TypeAck:
+		var ack protocol.Ack
+		if err := env.Unmarshal(&ack); err != nil {
+			return protocol.Handshake{}, err
+		}
+		agreed, err := ack.Handshake.Agree()
+		if err != nil {
+			return protocol.Handshake{}, fmt.Errorf("incompatible replica %s: %w", serverID, err)
+		}
+		log.Printf("[%s→%s] Protocol v%d, capabilities %v", c.clientID, serverID, agreed.Version, agreed.Capabilities)
+		return agreed, nil
+	case protocol.TypeNack:
+		var nack protocol.Nack
+		_ = env.Unmarshal(&nack)
+		return protocol.Handshake{}, fmt.Errorf("replica %s rejected client: %s", serverID, nack.Reason)
+	default:
+		return protocol.Handshake{}, fmt.Errorf("unexpected HELLO reply from %s: %s", serverID, reply)
+	}
+}
+
 func (c *client) activeReplicas() []*ReplicaConnection {
 	targets := make([]*ReplicaConnection, 0, len(c.replicas))
 	for _, r := range c.replicas {
@@ -155,6 +216,7 @@ func (c *client) SendMessage(message string) {
 	c.mu.Lock()
 	c.requestNum++
 	reqNum := c.requestNum
+	primaryID := c.primaryID
 	c.mu.Unlock()
 
 	req := QueuedRequest{
@@ -164,10 +226,14 @@ func (c *client) SendMessage(message string) {
 	}
 
 	var targets []*ReplicaConnection
-	for _, r := range c.activeReplicas() {
-		if r.ServerID == c.primaryID {
-			targets = append(targets, r)
-			break
+	if c.mode == Active {
+		targets = c.activeReplicas()
+	} else {
+		for _, r := range c.activeReplicas() {
+			if r.ServerID == primaryID {
+				targets = append(targets, r)
+				break
+			}
 		}
 	}
 	if len(targets) == 0 {
@@ -178,7 +244,7 @@ func (c *client) SendMessage(message string) {
 	log.Printf("[%s] Sending request_num=%d to %d replicas", c.clientID, reqNum, len(targets))
 
 	// Channel to collect responses
-	responseChan := make(chan ResponseMessage, len(targets))
+	responseChan := make(chan protocol.Reply, len(targets))
 	var wg sync.WaitGroup
 
 	// Send to all replicas
@@ -198,23 +264,29 @@ func (c *client) SendMessage(message string) {
 
 	// Process responses
 	firstReply := true
+	var first protocol.Reply
 	for resp := range responseChan {
 		c.replyMu.Lock()
 		if firstReply {
 			firstReply = false
+			first = resp
 			c.pendingReplies[reqNum] = true
 			c.replyMu.Unlock()
-			log.Printf("[%s←%s] Received reply for request_num=%d (state=%d)",
-				c.clientID, resp.ServerID, resp.RequestNum, resp.ServerState)
+			log.Printf("[%s←%s] Received reply for request_num=%d: %s",
+				c.clientID, resp.ServerID, resp.RequestNum, resp.Message)
 		} else {
 			c.replyMu.Unlock()
 			log.Printf("[%s←%s] request_num %d: Discarded duplicate reply from %s",
 				c.clientID, resp.ServerID, resp.RequestNum, resp.ServerID)
+			if resp.Message != first.Message {
+				log.Printf("[%s] WARNING: request_num %d replicas disagree: %s replied '%s', %s replied '%s'",
+					c.clientID, resp.RequestNum, first.ServerID, first.Message, resp.ServerID, resp.Message)
+			}
 		}
 	}
 }
 
-func (c *client) sendToReplica(replica *ReplicaConnection, req QueuedRequest, responseChan chan ResponseMessage) {
+func (c *client) sendToReplica(replica *ReplicaConnection, req QueuedRequest, responseChan chan protocol.Reply) {
 	replica.mu.Lock()
 
 	// Check if replica is permanently down - skip it entirely
@@ -242,30 +314,17 @@ func (c *client) sendToReplica(replica *ReplicaConnection, req QueuedRequest, re
 
 	conn := replica.Conn
 	reader := replica.reader
+	replica.inflight[req.RequestNum] = req
 	replica.mu.Unlock()
 
-	// Construct JSON request
-	reqMsg := RequestMessage{
-		Type:       "REQ",
-		ClientID:   c.clientID,
-		RequestNum: req.RequestNum,
-		Message:    req.Message,
-	}
-
-	jsonData, err := json.Marshal(reqMsg)
-	if err != nil {
-		log.Printf("[%s→%s] Error marshaling JSON: %v", c.clientID, replica.ServerID, err)
-		return
-	}
-
 	log.Printf("[%s→%s] Sending request_num=%d", c.clientID, replica.ServerID, req.RequestNum)
 
 	// Send request
-	err = utils.WriteLine(conn, string(jsonData))
+	err := protocol.Send(conn, c.clientID, req.RequestNum, protocol.Request{Message: req.Message})
 	if err != nil {
 		log.Printf("[%s→%s] Error sending request: %v", c.clientID, replica.ServerID, err)
 		c.markUnhealthy(replica)
-		c.enqueueRequest(replica, req)
+		c.requeue(replica, req)
 		go c.attemptReconnect(replica)
 		return
 	}
@@ -276,20 +335,155 @@ func (c *client) sendToReplica(replica *ReplicaConnection, req QueuedRequest, re
 	if err != nil {
 		log.Printf("[%s→%s] Error receiving reply: %v", c.clientID, replica.ServerID, err)
 		c.markUnhealthy(replica)
-		c.enqueueRequest(replica, req)
+		req.Sent = true
+		c.requeue(replica, req)
 		go c.attemptReconnect(replica)
 		return
 	}
+	c.takeInflight(replica, req.RequestNum)
 
-	// Parse JSON response
-	var respMsg ResponseMessage
-	if err := json.Unmarshal([]byte(reply), &respMsg); err == nil {
-		responseChan <- respMsg
-	} else {
+	if strings.HasPrefix(reply, "ERROR") {
+		log.Printf("[%s→%s] Server refused request_num=%d: %s", c.clientID, replica.ServerID, req.RequestNum, reply)
+		return
+	}
+
+	// Parse response
+	env, err := protocol.Decode(reply)
+	var resp protocol.Response
+	if err == nil {
+		err = env.Unmarshal(&resp)
+	}
+	if err != nil {
 		log.Printf("[%s→%s] Failed to parse response: %v", c.clientID, replica.ServerID, err)
+		return
+	}
+	responseChan <- protocol.Reply{ServerID: env.Sender, RequestNum: env.Seq, Message: resp.Message}
+}
+
+// watchPrimary subscribes to RM and follows primary changes, reconnecting with backoff
+func (c *client) watchPrimary() {
+	attempt := 0
+	for {
+		conn, err := utils.Dial(c.rmAddr, 0)
+		if err == nil {
+			attempt = 0
+			c.followPrimary(conn)
+		} else {
+			log.Printf("[%s] Failed to connect to RM at %s: %v", c.clientID, c.rmAddr, err)
+		}
+		delay := c.calculateBackoffDelay(attempt)
+		log.Printf("[%s] Reconnecting to RM in %v...", c.clientID, delay)
+		time.Sleep(delay)
+		attempt++
 	}
 }
 
+func (c *client) followPrimary(conn net.Conn) {
+	defer conn.Close()
+
+	if err := utils.WriteLine(conn, fmt.Sprintf("%s %s", subscribe, c.clientID)); err != nil {
+		log.Printf("[%s] Failed to subscribe to RM: %v", c.clientID, err)
+		return
+	}
+	log.Printf("[%s] Subscribed to primary updates from RM at %s", c.clientID, c.rmAddr)
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := utils.ReadLine(reader)
+		if err != nil {
+			log.Printf("[%s] RM connection closed: %v", c.clientID, err)
+			return
+		}
+		parts := strings.Fields(line)
+		if len(parts) == 0 || parts[0] != primary {
+			log.Printf("[%s] Unexpected message from RM: %s", c.clientID, line)
+			continue
+		}
+		newPrimary := ""
+		if len(parts) > 1 {
+			newPrimary = parts[1]
+		}
+		c.setPrimary(newPrimary)
+	}
+}
+
+// setPrimary switches the request target and revives the new primary's connection if needed
+func (c *client) setPrimary(primaryID string) {
+	c.mu.Lock()
+	old := c.primaryID
+	c.primaryID = primaryID
+	c.mu.Unlock()
+
+	if old == primaryID {
+		return
+	}
+	log.Printf("[%s] Primary changed: %s -> %s", c.clientID, old, primaryID)
+
+	for _, r := range c.replicas {
+		if r.ServerID != primaryID {
+			continue
+		}
+		r.mu.Lock()
+		r.permanentlyDown = false
+		healthy := r.IsHealthy
+		r.mu.Unlock()
+		if !healthy {
+			go c.attemptReconnect(r)
+		}
+		if c.mode == Passive {
+			c.moveRequests(r)
+		}
+	}
+}
+
+// moveRequests hands the requests queued for or in flight to other replicas
+// over to the new primary. A request the old primary already applied is
+// answered from the new primary's reply cache instead of being re-applied.
+func (c *client) moveRequests(to *ReplicaConnection) {
+	var reqs []QueuedRequest
+	for _, r := range c.replicas {
+		if r == to {
+			continue
+		}
+		r.mu.Lock()
+		reqs = append(reqs, r.Queue...)
+		for _, req := range r.inflight {
+			req.Sent = true
+			reqs = append(reqs, req)
+		}
+		r.Queue = make([]QueuedRequest, 0)
+		r.inflight = make(map[int]QueuedRequest)
+		r.mu.Unlock()
+	}
+	if len(reqs) == 0 {
+		return
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].RequestNum < reqs[j].RequestNum })
+	log.Printf("[%s] Moving %d unanswered requests to new primary %s", c.clientID, len(reqs), to.ServerID)
+	go c.resend(to, reqs)
+}
+
+// takeInflight marks a request as answered or failed on a replica; false if
+// it was moved to another replica meanwhile
+func (c *client) takeInflight(replica *ReplicaConnection, reqNum int) bool {
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	_, ok := replica.inflight[reqNum]
+	delete(replica.inflight, reqNum)
+	return ok
+}
+
+// requeue queues a request whose send or reply failed, unless a primary
+// change already moved it elsewhere
+func (c *client) requeue(replica *ReplicaConnection, req QueuedRequest) {
+	if !c.takeInflight(replica, req.RequestNum) {
+		log.Printf("[%s→%s] request_num=%d was moved to another replica, not queuing it here",
+			c.clientID, replica.ServerID, req.RequestNum)
+		return
+	}
+	c.enqueueRequest(replica, req)
+}
+
 func (c *client) enqueueRequest(replica *ReplicaConnection, req QueuedRequest) {
 	replica.mu.Lock()
 	defer replica.mu.Unlock()
@@ -397,22 +591,44 @@ func (c *client) flushQueue(replica *ReplicaConnection) {
 	replica.Queue = make([]QueuedRequest, 0)
 	replica.mu.Unlock()
 
-	for _, req := range queue {
+	c.resend(replica, queue)
+}
+
+// resend sends earlier requests to a replica one at a time, in order. A
+// request that may already have been applied is only sent again to a replica
+// that agreed on exactly_once, whose reply cache keeps it from applying twice.
+// While the replica is down its requests are queued for the next connection.
+func (c *client) resend(replica *ReplicaConnection, reqs []QueuedRequest) {
+	for _, req := range reqs {
+		replica.mu.Lock()
+		canResend := !replica.IsHealthy || replica.proto.Has(protocol.CapExactlyOnce)
+		replica.mu.Unlock()
+		if req.Sent && !canResend {
+			log.Printf("[%s→%s] Not resending request_num=%d: it may have been applied and the replica has no reply cache",
+				c.clientID, replica.ServerID, req.RequestNum)
+			continue
+		}
 		log.Printf("[%s→%s] Sending queued request_num=%d (queued for %v)",
 			c.clientID, replica.ServerID, req.RequestNum, time.Since(req.Timestamp))
 
-		// Create a dummy response channel (we don't wait for responses during flush)
-		responseChan := make(chan ResponseMessage, 1)
+		responseChan := make(chan protocol.Reply, 1)
 		c.sendToReplica(replica, req, responseChan)
 		close(responseChan)
 
-		// Drain the channel
-		for range responseChan {
+		for resp := range responseChan {
+			c.replyMu.Lock()
+			c.pendingReplies[req.RequestNum] = true
+			c.replyMu.Unlock()
+			log.Printf("[%s←%s] Received reply for queued request_num=%d: %s",
+				c.clientID, resp.ServerID, resp.RequestNum, resp.Message)
 		}
 	}
 }
 
 func (c *client) calculateBackoffDelay(attempt int) time.Duration {
+	if attempt > 16 {
+		attempt = 16
+	}
 	delay := time.Duration(1<<uint(attempt)) * c.baseDelay
 	if delay > 30*time.Second {
 		delay = 30 * time.Second
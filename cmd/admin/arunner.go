@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wenyinh/18749-project/protocol"
+	"github.com/wenyinh/18749-project/server"
+	"github.com/wenyinh/18749-project/utils"
+)
+
+// bin/admin -server 127.0.0.1:9001 status
+// bin/admin -server 127.0.0.1:9001 policy interval=2s requests=100 adaptive=true
+// bin/admin -server 127.0.0.1:9001 checkpoint
+func main() {
+	addr := flag.String("server", "127.0.0.1:9001", "server address")
+	timeout := flag.Duration("timeout", 3*time.Second, "timeout for the admin request")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command>\n\nCommands:\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "  status                  show role, checkpoint policy and backup lag of a server")
+		fmt.Fprintln(os.Stderr, "  checkpoint              make the primary checkpoint now and wait for backup acks")
+		fmt.Fprintln(os.Stderr, "  policy key=value ...    change the checkpoint policy at runtime;")
+		fmt.Fprintln(os.Stderr, "                          keys: interval (e.g. 2s), requests, adaptive (true|false), full_every")
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flag.PrintDefaults()
+	}
+	framing := flag.Bool("framing", false, "offer length-prefixed framing on outgoing connections (line-based peers still work)")
+	flag.Parse()
+	utils.Framing = *framing
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch strings.ToLower(flag.Arg(0)) {
+	case "status":
+		printStatus(queryStatus(*addr, *timeout))
+	case "checkpoint":
+		// The server waits up to CheckpointNowTimeout for backup acks
+		reply, err := request(*addr, server.CheckpointNow, *timeout+server.CheckpointNowTimeout)
+		if err != nil {
+			log.Fatalf("%s to %s failed: %v", server.CheckpointNow, *addr, err)
+		}
+		var res server.CheckpointNowMessage
+		if err := json.Unmarshal([]byte(reply), &res); err != nil || res.Type != server.CheckpointNow {
+			log.Fatalf("%s refused: %s", *addr, reply)
+		}
+		printCheckpoint(res)
+	case "policy":
+		if flag.NArg() < 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		line := server.CheckpointPolicyCmd + " " + strings.Join(flag.Args()[1:], " ")
+		reply, err := request(*addr, line, *timeout)
+		if err != nil {
+			log.Fatalf("%s to %s failed: %v", server.CheckpointPolicyCmd, *addr, err)
+		}
+		if env, err := protocol.Decode(reply); err != nil || env.Type != protocol.TypeAck {
+			log.Fatalf("%s rejected the policy: %s", *addr, reply)
+		}
+		printStatus(queryStatus(*addr, *timeout))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func queryStatus(addr string, timeout time.Duration) server.StatusMessage {
+	reply, err := request(addr, server.Status, timeout)
+	if err != nil {
+		log.Fatalf("STATUS to %s failed: %v", addr, err)
+	}
+	var st server.StatusMessage
+	if err := json.Unmarshal([]byte(reply), &st); err != nil || st.Type != server.Status {
+		log.Fatalf("unexpected reply from %s: %s", addr, reply)
+	}
+	return st
+}
+
+// request sends one admin line and returns the single-line reply
+func request(addr, line string, timeout time.Duration) (string, error) {
+	conn, err := utils.Dial(addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err := utils.WriteLine(conn, line); err != nil {
+		return "", err
+	}
+	return utils.ReadLine(bufio.NewReader(conn))
+}
+
+func printStatus(st server.StatusMessage) {
+	green := "\033[32m"
+	yellow := "\033[33m"
+	reset := "\033[0m"
+	fmt.Printf("%s%s: %s, %s mode, ready=%v, checkpoint #%d, last_seq=%d%s\n",
+		green, st.ReplicaId, st.Role, st.Mode, st.Ready, st.CheckpointNo, st.LastSeq, reset)
+	p := st.Policy
+	fmt.Printf("  checkpoint policy: interval=%dms requests=%d adaptive=%v full_every=%d (effective interval %dms)\n",
+		p.IntervalMs, p.Requests, p.Adaptive, p.FullEvery, p.EffectiveIntervalMs)
+	if len(st.Backups) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(st.Backups))
+	for id := range st.Backups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		b := st.Backups[id]
+		color := yellow
+		if b.SafeToPromote {
+			color = green
+		}
+		lastAck := "never"
+		if !b.LastAck.IsZero() {
+			lastAck = b.LastAck.Format("15:04:05.000")
+		}
+		fmt.Printf("%s  %s: connected=%v, acked #%d (last_seq=%d, lag=%d, at %s), safe to promote=%v%s\n",
+			color, id, b.Connected, b.AckedCheckpoint, b.AckedSeq, b.CheckpointLag, lastAck, b.SafeToPromote, reset)
+	}
+}
+
+func printCheckpoint(res server.CheckpointNowMessage) {
+	green := "\033[32m"
+	yellow := "\033[33m"
+	reset := "\033[0m"
+	acked := "no backups"
+	if len(res.Acked) > 0 {
+		acked = strings.Join(res.Acked, ", ")
+	}
+	if len(res.Missing) == 0 {
+		fmt.Printf("%s%s: checkpoint #%d acked by %s%s\n", green, res.ReplicaId, res.CheckpointNum, acked, reset)
+		return
+	}
+	fmt.Printf("%s%s: checkpoint #%d acked by %s, not acked by %s%s\n",
+		yellow, res.ReplicaId, res.CheckpointNum, acked, strings.Join(res.Missing, ", "), reset)
+}
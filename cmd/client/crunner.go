@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/wenyinh/18749-project/client"
+	"github.com/wenyinh/18749-project/utils"
 )
 
 func main() {
@@ -16,7 +19,12 @@ func main() {
 	interval := flag.Duration("interval", 3*time.Second, "interval between requests")
 	autoSend := flag.Bool("auto", false, "automatically send requests")
 	primary := flag.String("primary", "S1", "primary replica id")
+	rmAddr := flag.String("rm", "", "RM address for primary updates (empty = always use -primary)")
+	modeFlag := flag.String("mode", "passive", "replication mode: active (send to all replicas) | passive (send to primary)")
+	app := flag.String("app", "counter", "server application, selects the auto-mode workload: counter|kv")
+	framing := flag.Bool("framing", false, "offer length-prefixed framing on outgoing connections (line-based peers still work)")
 	flag.Parse()
+	utils.Framing = *framing
 
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
@@ -26,8 +34,18 @@ func main() {
 		log.Fatal("No server addresses provided")
 	}
 
+	var mode client.Mode
+	switch strings.ToLower(strings.TrimSpace(*modeFlag)) {
+	case "passive":
+		mode = client.Passive
+	case "active":
+		mode = client.Active
+	default:
+		log.Fatalf("invalid -mode: %s (use active|passive)", *modeFlag)
+	}
+
 	// Create client
-	c := client.NewClient(*clientID, serverAddrs, *primary)
+	c := client.NewClient(*clientID, serverAddrs, *primary, *rmAddr, mode)
 
 	// Connect
 	if err := c.Connect(); err != nil {
@@ -38,46 +56,86 @@ func main() {
 	if *autoSend {
 		// Auto mode: continuously send requests
 		log.Printf("[%s] Starting auto-send mode (interval: %v)", *clientID, *interval)
-		reqNum := 0
-		for {
-			reqNum++
-			message := fmt.Sprintf("Auto request %d from %s", reqNum, *clientID)
-			c.SendMessage(message)
-			time.Sleep(*interval)
-		}
+		runAuto(c, *clientID, *app, *interval)
 	} else {
 		// Manual mode: wait for user input
 		fmt.Printf("Client %s connected. Commands:\n", *clientID)
 		fmt.Println("  Type messages and press Enter to send")
+		fmt.Println("  Key-value commands (-app kv servers): PUT <key> <value>, GET <key>, DELETE <key>, CAS <key> <old> <new>")
 		fmt.Println("  'quit' to exit")
 		fmt.Println("  'auto' to switch to auto mode")
 
-		var input string
+		scanner := bufio.NewScanner(os.Stdin)
 		for {
 			fmt.Print("> ")
-			fmt.Scanln(&input)
+			if !scanner.Scan() {
+				break
+			}
 
-			input = strings.TrimSpace(input)
+			input := strings.TrimSpace(scanner.Text())
 			if input == "quit" {
 				break
 			}
 
 			if input == "auto" {
 				log.Printf("[%s] Switching to auto-send mode", *clientID)
-				reqNum := 0
-				for {
-					reqNum++
-					message := fmt.Sprintf("Auto request %d from %s", reqNum, *clientID)
-					c.SendMessage(message)
-					time.Sleep(*interval)
-				}
+				runAuto(c, *clientID, *app, *interval)
+			}
+
+			if input == "" {
+				continue
 			}
+			message, err := parseKVCommand(input)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.SendMessage(message)
+		}
+	}
+}
 
-			if input != "" {
-				c.SendMessage(input)
+// runAuto sends requests forever; the kv workload writes and reads back keys owned by this client
+func runAuto(c client.Client, clientID, app string, interval time.Duration) {
+	reqNum := 0
+	for {
+		reqNum++
+		var message string
+		if app == "kv" {
+			key := fmt.Sprintf("%s-k%d", clientID, (reqNum+1)/2%10)
+			if reqNum%2 == 1 {
+				message = fmt.Sprintf("PUT %s %d", key, reqNum)
+			} else {
+				message = fmt.Sprintf("GET %s", key)
 			}
+		} else {
+			message = fmt.Sprintf("Auto request %d from %s", reqNum, clientID)
 		}
+		c.SendMessage(message)
+		time.Sleep(interval)
+	}
+}
+
+// parseKVCommand checks the arity of key-value commands and upper-cases the verb.
+// Anything that is not a key-value command is sent unchanged.
+func parseKVCommand(input string) (string, error) {
+	parts := strings.Fields(input)
+	verb := strings.ToUpper(parts[0])
+	var ok bool
+	switch verb {
+	case "PUT":
+		ok = len(parts) >= 3
+	case "GET", "DELETE":
+		ok = len(parts) == 2
+	case "CAS":
+		ok = len(parts) == 4
+	default:
+		return input, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("usage: PUT <key> <value> | GET <key> | DELETE <key> | CAS <key> <old> <new>")
 	}
+	return verb + strings.TrimPrefix(input, parts[0]), nil
 }
 
 func parseServerAddrs(servers string) map[string]string {
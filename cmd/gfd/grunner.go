@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/wenyinh/18749-project/detector"
 	"github.com/wenyinh/18749-project/gfd"
 )
 
@@ -12,10 +14,34 @@ func main() {
 	addr := flag.String("addr", ":8000", "GFD listen address")
 	hbFreq := flag.Duration("hb", 1*time.Second, "Heartbeat frequency for GFD->LFD")
 	timeout := flag.Duration("timeout", 3*time.Second, "Heartbeat timeout")
+	detectorFlag := flag.String("detector", "fixed", "failure detector: fixed (fail after -timeout without heartbeat) | phi (phi-accrual)")
+	phiThreshold := flag.Float64("phi-threshold", 8, "phi detector: suspicion level at which a peer is declared failed")
+	phiWindow := flag.Int("phi-window", 100, "phi detector: number of heartbeat inter-arrival times to learn from")
+	phiMinStdDev := flag.Duration("phi-min-stddev", 200*time.Millisecond, "phi detector: lower bound for the inter-arrival standard deviation")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	g := gfd.NewGFD(*addr, *hbFreq, *timeout)
+
+	var kind detector.Kind
+	switch strings.ToLower(strings.TrimSpace(*detectorFlag)) {
+	case "fixed":
+		kind = detector.FixedTimeout
+	case "phi":
+		kind = detector.PhiAccrual
+	default:
+		log.Fatalf("invalid -detector: %s (use fixed|phi)", *detectorFlag)
+	}
+	if kind == detector.PhiAccrual && (*phiThreshold <= 0 || *phiWindow < 1) {
+		log.Fatalf("invalid phi detector settings: -phi-threshold must be > 0 and -phi-window >= 1")
+	}
+	detectors := detector.Policy{
+		Kind:      kind,
+		Threshold: *phiThreshold,
+		Window:    *phiWindow,
+		MinStdDev: *phiMinStdDev,
+	}
+
+	g := gfd.NewGFD(*addr, *hbFreq, *timeout, detectors)
 	if err := g.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -3,25 +3,119 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/wenyinh/18749-project/detector"
 	"github.com/wenyinh/18749-project/lfd"
+	"github.com/wenyinh/18749-project/utils"
 )
 
+// bin/lfd -id LFD1 -server-id S1 -target 127.0.0.1:9001 -gfd 127.0.0.1:8000
+// bin/lfd -id LFD-A -servers "S1=127.0.0.1:9001,S2=127.0.0.1:9002" -gfd 127.0.0.1:8000
+// bin/lfd -id LFD1 -target 127.0.0.1:9001 -restart on-failure -- bin/server -rid S1 -addr :9001
+func parseServers(s string) map[string]string {
+	m := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return m
+	}
+	for _, p := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			id := strings.TrimSpace(kv[0])
+			addr := strings.TrimSpace(kv[1])
+			if id != "" && addr != "" {
+				m[id] = addr
+			}
+		}
+	}
+	return m
+}
+
 func main() {
 	targetAddr := flag.String("target", "127.0.0.1:9000", "server address to monitor")
 	hb := flag.Duration("hb", 1*time.Second, "heartbeat frequency (e.g. 1s, 500ms)")
 	timeout := flag.Duration("timeout", 3*time.Second, "heartbeat timeout (e.g. 3s)")
 	lfdID := flag.String("id", "LFD1", "LFD identifier")
+	serverID := flag.String("server-id", "", "ID of the server to monitor, must match its -rid (default: S<n> for -id LFD<n>)")
+	servers := flag.String("servers", "", "monitor several local servers instead of -server-id/-target, comma-separated list: S1=ip:port,S2=ip:port")
 	gfdAddr := flag.String("gfd", "127.0.0.1:8000", "GFD address")
 	maxRetries := flag.Int("max-retries", 3, "maximum reconnection attempts")
 	baseDelay := flag.Duration("base-delay", 1*time.Second, "base delay for exponential backoff")
 	maxDelay := flag.Duration("max-delay", 10*time.Second, "maximum delay for exponential backoff")
+	framing := flag.Bool("framing", false, "offer length-prefixed framing on outgoing connections (line-based peers still work)")
+	restartFlag := flag.String("restart", "on-failure", "supervisor mode: when to restart the server: on-failure|always|never")
+	maxRestarts := flag.Int("max-restarts", 5, "supervisor mode: give up after this many restarts in a row (0 = unlimited)")
+	restartDelay := flag.Duration("restart-delay", 1*time.Second, "supervisor mode: delay before a restart, doubled for each restart in a row up to -max-delay")
+	detectorFlag := flag.String("detector", "fixed", "failure detector: fixed (fail after -timeout without heartbeat) | phi (phi-accrual)")
+	phiThreshold := flag.Float64("phi-threshold", 8, "phi detector: suspicion level at which a peer is declared failed")
+	phiWindow := flag.Int("phi-window", 100, "phi detector: number of heartbeat inter-arrival times to learn from")
+	phiMinStdDev := flag.Duration("phi-min-stddev", 200*time.Millisecond, "phi detector: lower bound for the inter-arrival standard deviation")
 	flag.Parse()
+	utils.Framing = *framing
 
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
-	l := lfd.NewLFD(*lfdID, *targetAddr, *gfdAddr, *hb, *timeout, *maxRetries, *baseDelay, *maxDelay)
+	var restart lfd.RestartMode
+	switch strings.ToLower(strings.TrimSpace(*restartFlag)) {
+	case "on-failure":
+		restart = lfd.RestartOnFailure
+	case "always":
+		restart = lfd.RestartAlways
+	case "never":
+		restart = lfd.RestartNever
+	default:
+		log.Fatalf("invalid -restart: %s (use on-failure|always|never)", *restartFlag)
+	}
+
+	var kind detector.Kind
+	switch strings.ToLower(strings.TrimSpace(*detectorFlag)) {
+	case "fixed":
+		kind = detector.FixedTimeout
+	case "phi":
+		kind = detector.PhiAccrual
+	default:
+		log.Fatalf("invalid -detector: %s (use fixed|phi)", *detectorFlag)
+	}
+	if kind == detector.PhiAccrual && (*phiThreshold <= 0 || *phiWindow < 1) {
+		log.Fatalf("invalid phi detector settings: -phi-threshold must be > 0 and -phi-window >= 1")
+	}
+	detectors := detector.Policy{
+		Kind:      kind,
+		Threshold: *phiThreshold,
+		Window:    *phiWindow,
+		MinStdDev: *phiMinStdDev,
+	}
+
+	// Anything after the flags is the server command line to supervise
+	sup := lfd.Supervision{
+		Command:      flag.Args(),
+		Restart:      restart,
+		MaxRestarts:  *maxRestarts,
+		RestartDelay: *restartDelay,
+	}
+
+	monitored := parseServers(*servers)
+	if *servers != "" {
+		// -servers replaces -server-id/-target; mixing them would silently drop one
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "server-id" || f.Name == "target" {
+				log.Fatalf("-%s cannot be combined with -servers (list every server in -servers instead)", f.Name)
+			}
+		})
+		if len(monitored) == 0 {
+			log.Fatalf("invalid -servers: %q (use S1=ip:port,S2=ip:port)", *servers)
+		}
+	}
+	if len(monitored) == 0 {
+		id := *serverID
+		if id == "" {
+			id = lfd.DefaultServerID(*lfdID)
+		}
+		monitored[id] = *targetAddr
+	}
+
+	l := lfd.NewLFD(*lfdID, monitored, *gfdAddr, *hb, *timeout, *maxRetries, *baseDelay, *maxDelay, sup, detectors)
 	if err := l.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/wenyinh/18749-project/rm"
+	"github.com/wenyinh/18749-project/utils"
+)
+
+// bin/rm -id RM -addr :7000 -gfd 127.0.0.1:8000 \
+// -servers "S1=127.0.0.1:9001,S2=127.0.0.1:9002,S3=127.0.0.1:9003"
+func parseServers(s string) map[string]string {
+	m := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return m
+	}
+	for _, p := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			id := strings.TrimSpace(kv[0])
+			addr := strings.TrimSpace(kv[1])
+			if id != "" && addr != "" {
+				m[id] = addr
+			}
+		}
+	}
+	return m
+}
+
+func main() {
+	rmID := flag.String("id", "RM", "RM identifier")
+	addr := flag.String("addr", ":7000", "RM listen address for client subscriptions")
+	gfdAddr := flag.String("gfd", "127.0.0.1:8000", "GFD address")
+	servers := flag.String("servers", "S1=127.0.0.1:9001,S2=127.0.0.1:9002,S3=127.0.0.1:9003", "server addresses (format: ID1=addr1,ID2=addr2,...)")
+	timeout := flag.Duration("timeout", 3*time.Second, "timeout for GFD/server/client I/O")
+	baseDelay := flag.Duration("base-delay", 1*time.Second, "base delay for exponential backoff when reconnecting to GFD")
+	maxDelay := flag.Duration("max-delay", 10*time.Second, "maximum delay for exponential backoff")
+	framing := flag.Bool("framing", false, "offer length-prefixed framing on outgoing connections (line-based peers still work)")
+	flag.Parse()
+	utils.Framing = *framing
+
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	serverAddrs := parseServers(*servers)
+	if len(serverAddrs) == 0 {
+		log.Fatal("No server addresses provided")
+	}
+
+	m := rm.NewRM(*rmID, *addr, *gfdAddr, serverAddrs, *timeout, *baseDelay, *maxDelay)
+	if err := m.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
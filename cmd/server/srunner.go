@@ -7,12 +7,13 @@ import (
 	"time"
 
 	"github.com/wenyinh/18749-project/server"
+	"github.com/wenyinh/18749-project/utils"
 )
 
-// bin/server -role primary \
+// bin/server -role primary -mode passive \
 // -rid S1 -addr :9001 -init_state 0 \
 // -backups "S2=10.0.0.2:9002,S3=10.0.0.3:9003" \
-// -ckpt_ms 3000
+// -ckpt_ms 3000 -ckpt_reqs 100 -ckpt_adaptive
 func parseBackups(s string) map[string]string {
 	m := make(map[string]string)
 	if strings.TrimSpace(s) == "" {
@@ -35,12 +36,21 @@ func parseBackups(s string) map[string]string {
 func main() {
 	addr := flag.String("addr", ":9000", "server listen address, e.g. :9000 or 127.0.0.1:9000")
 	rid := flag.String("rid", "S1", "replica id for logs")
-	init := flag.Int("init_state", 0, "initial server state counter")
+	init := flag.Int("init_state", 0, "initial server state counter (counter app only)")
+	appFlag := flag.String("app", "counter", "replicated application: counter|kv")
 
-	roleFlag := flag.String("role", "primary", "server role: primary|backup")
-	backupsFlag := flag.String("backups", "", "for primary only, comma-separated list: S2=ip:port,S3=ip:port")
+	roleFlag := flag.String("role", "primary", "server role: primary|backup (in active mode the primary is the sequencer)")
+	modeFlag := flag.String("mode", "passive", "replication mode: active|passive")
+	backupsFlag := flag.String("backups", "", "replica peers checkpointed while this server is primary, comma-separated list: S2=ip:port,S3=ip:port")
 	ckptMs := flag.Int("ckpt_ms", 5000, "checkpoint interval in milliseconds (primary only)")
+	ckptReqs := flag.Int("ckpt_reqs", 0, "also checkpoint after this many applied requests, whichever comes first (0 = time only)")
+	adaptive := flag.Bool("ckpt_adaptive", false, "adapt the checkpoint interval to request rate and backup lag, within [ckpt_ms/4, ckpt_ms*4]")
+	fullEvery := flag.Int("full_every", 10, "send a full checkpoint every N checkpoints and deltas in between (kv app only; 1 = always full)")
+	dataDir := flag.String("data_dir", "", "directory for durable checkpoints and the WAL; the latest checkpoint is reloaded at startup and overrides -init_state (needs -ckpt_ms or, in passive mode, -ckpt_reqs)")
+	fsyncFlag := flag.String("fsync", "batch", "WAL fsync policy with -data_dir: always|batch|never")
+	framing := flag.Bool("framing", false, "offer length-prefixed framing on outgoing connections (line-based peers still work)")
 	flag.Parse()
+	utils.Framing = *framing
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
 	var role server.Role
@@ -53,20 +63,61 @@ func main() {
 		log.Fatalf("invalid -role: %s (use primary|backup)", *roleFlag)
 	}
 
-	var backups map[string]string
-	if role == server.Primary {
-		backups = parseBackups(*backupsFlag)
-	} else {
-		backups = nil
+	var mode server.Mode
+	switch strings.ToLower(strings.TrimSpace(*modeFlag)) {
+	case "passive":
+		mode = server.Passive
+	case "active":
+		mode = server.Active
+	default:
+		log.Fatalf("invalid -mode: %s (use active|passive)", *modeFlag)
+	}
+
+	var app server.StateMachine
+	switch strings.ToLower(strings.TrimSpace(*appFlag)) {
+	case "counter":
+		app = server.NewCounter(*init)
+	case "kv":
+		app = server.NewKVStore()
+	default:
+		log.Fatalf("invalid -app: %s (use counter|kv)", *appFlag)
 	}
+
+	var fsync server.FsyncPolicy
+	switch strings.ToLower(strings.TrimSpace(*fsyncFlag)) {
+	case "always":
+		fsync = server.FsyncAlways
+	case "batch":
+		fsync = server.FsyncBatch
+	case "never":
+		fsync = server.FsyncNever
+	default:
+		log.Fatalf("invalid -fsync: %s (use always|batch|never)", *fsyncFlag)
+	}
+
+	policy := server.CheckpointPolicy{
+		Interval:  time.Duration(*ckptMs) * time.Millisecond,
+		Requests:  *ckptReqs,
+		Adaptive:  *adaptive,
+		FullEvery: *fullEvery,
+	}
+	if *dataDir != "" && !policy.TruncatesWAL(mode) {
+		log.Fatalf("-data_dir needs -ckpt_ms > 0 (or -ckpt_reqs > 0 in passive mode), the WAL is only truncated by persisted checkpoints")
+	}
+
+	// Backups may be promoted at runtime, so every replica keeps the peer list
+	backups := parseBackups(*backupsFlag)
 	s := server.NewServer(
 		*addr,
 		*rid,
-		*init,
+		app,
 		role,
+		mode,
 		backups,
 		nil,
-		time.Duration(*ckptMs)*time.Millisecond,
+		policy,
+		*dataDir,
+		fsync,
 	)
 	if err := s.Run(); err != nil {
 		log.Fatal(err)
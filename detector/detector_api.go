@@ -0,0 +1,66 @@
+package detector
+
+import (
+	"fmt"
+	"time"
+)
+
+// Detector decides from heartbeat arrival times whether a peer has failed.
+// Detectors are not safe for concurrent use.
+type Detector interface {
+	// Heartbeat records a heartbeat (or heartbeat reply) received at now
+	Heartbeat(now time.Time)
+	// Reset starts a new heartbeat stream at now, e.g. after reconnecting;
+	// what was learned about earlier inter-arrival times is kept
+	Reset(now time.Time)
+	// Suspicion is how strongly the peer is suspected at now, 0 if not at all
+	Suspicion(now time.Time) float64
+	// Failed reports whether the peer is considered failed at now
+	Failed(now time.Time) bool
+	// Deadline is when the peer will be considered failed if no heartbeat arrives
+	Deadline() time.Time
+}
+
+// Kind selects a failure detector
+type Kind int
+
+const (
+	FixedTimeout Kind = iota // fail after a fixed time without heartbeat
+	PhiAccrual               // fail once the phi suspicion level reaches a threshold
+)
+
+func (k Kind) String() string {
+	switch k {
+	case FixedTimeout:
+		return "fixed"
+	default:
+		return "phi"
+	}
+}
+
+// Policy configures the detectors a component creates, one per monitored
+// peer. The phi-accrual settings are ignored by the fixed timeout detector.
+type Policy struct {
+	Kind      Kind
+	Threshold float64       // Phi at which a peer is considered failed
+	Window    int           // Inter-arrival times remembered
+	MinStdDev time.Duration // Lower bound for the standard deviation of inter-arrival times
+}
+
+func (p Policy) String() string {
+	if p.Kind == FixedTimeout {
+		return p.Kind.String()
+	}
+	return fmt.Sprintf("%v threshold=%g window=%d min_stddev=%v", p.Kind, p.Threshold, p.Window, p.MinStdDev)
+}
+
+// New creates a detector for a peer expected to send a heartbeat every
+// interval. A fixed timeout detector fails the peer after timeout without
+// heartbeat; a phi-accrual detector uses interval until it has measured the
+// actual inter-arrival times.
+func New(p Policy, interval, timeout time.Duration) Detector {
+	if p.Kind == PhiAccrual {
+		return newPhiAccrual(p, interval)
+	}
+	return newFixedTimeout(timeout)
+}
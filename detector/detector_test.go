@@ -0,0 +1,129 @@
+package detector
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// feed resets d at start and sends n heartbeats every interval; it returns
+// the time of the last one
+func feed(d Detector, start time.Time, n int, interval time.Duration) time.Time {
+	d.Reset(start)
+	now := start
+	for i := 0; i < n; i++ {
+		now = now.Add(interval)
+		d.Heartbeat(now)
+	}
+	return now
+}
+
+func TestPhiZeroVariance(t *testing.T) {
+	d := New(Policy{Kind: PhiAccrual, Threshold: 8, Window: 100}, 100*time.Millisecond, 0)
+	last := feed(d, time.Now(), 20, 100*time.Millisecond)
+
+	// Identical intervals fall back to the 1ms minimum deviation
+	if s := d.Suspicion(last.Add(100 * time.Millisecond)); math.Abs(s-math.Log10(2)) > 1e-9 {
+		t.Errorf("phi at the mean interval = %v, want log10(2)", s)
+	}
+	for _, elapsed := range []time.Duration{0, 50 * time.Millisecond, 105 * time.Millisecond, 110 * time.Millisecond, time.Hour} {
+		s := d.Suspicion(last.Add(elapsed))
+		if math.IsNaN(s) || s < 0 {
+			t.Errorf("phi %v after the last heartbeat = %v, want a non-negative number", elapsed, s)
+		}
+	}
+	if d.Failed(last.Add(102 * time.Millisecond)) {
+		t.Error("failed 2 deviations after the mean interval")
+	}
+	if !d.Failed(last.Add(110 * time.Millisecond)) {
+		t.Error("not failed 10 deviations after the mean interval")
+	}
+	if !d.Failed(last.Add(time.Hour)) {
+		t.Error("not failed an hour after the last heartbeat")
+	}
+}
+
+func TestPhiDeadline(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    Policy
+		intervals []time.Duration
+	}{
+		{"bootstrap", Policy{Kind: PhiAccrual, Threshold: 8, Window: 10}, nil},
+		{"zero variance", Policy{Kind: PhiAccrual, Threshold: 8, Window: 10},
+			[]time.Duration{time.Second, time.Second, time.Second}},
+		{"jitter", Policy{Kind: PhiAccrual, Threshold: 3, Window: 10, MinStdDev: 10 * time.Millisecond},
+			[]time.Duration{900 * time.Millisecond, time.Second, 1100 * time.Millisecond, time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(tt.policy, time.Second, 0)
+			now := time.Now()
+			d.Reset(now)
+			for _, iv := range tt.intervals {
+				now = now.Add(iv)
+				d.Heartbeat(now)
+			}
+			deadline := d.Deadline()
+			if !deadline.After(now) {
+				t.Fatalf("deadline %v is not after the last heartbeat", deadline.Sub(now))
+			}
+			if d.Failed(deadline.Add(-time.Millisecond)) {
+				t.Errorf("failed 1ms before the deadline (%v after the last heartbeat)", deadline.Sub(now))
+			}
+			if !d.Failed(deadline.Add(time.Millisecond)) {
+				t.Errorf("not failed 1ms after the deadline (%v after the last heartbeat)", deadline.Sub(now))
+			}
+		})
+	}
+}
+
+func TestPhiBootstrap(t *testing.T) {
+	d := New(Policy{Kind: PhiAccrual, Threshold: 8, Window: 10}, time.Second, 0).(*phiAccrual)
+	mean, std := d.stats()
+	if mean != 1 || std != 0.25 {
+		t.Errorf("bootstrap stats = %v, %v, want 1, 0.25", mean, std)
+	}
+}
+
+func TestPhiWindow(t *testing.T) {
+	d := New(Policy{Kind: PhiAccrual, Threshold: 8, Window: 3}, time.Second, 0).(*phiAccrual)
+	last := feed(d, time.Now(), 5, time.Second)
+	feed(d, last, 3, 100*time.Millisecond)
+	// Only the last Window intervals count
+	if mean, _ := d.stats(); math.Abs(mean-0.1) > 1e-9 {
+		t.Errorf("mean = %v after the window turned over, want 0.1", mean)
+	}
+}
+
+func TestPhiResetKeepsHistory(t *testing.T) {
+	d := New(Policy{Kind: PhiAccrual, Threshold: 8, Window: 10}, time.Second, 0)
+	last := feed(d, time.Now(), 5, 100*time.Millisecond)
+	// A reconnect gap is not an inter-arrival time
+	restart := last.Add(time.Minute)
+	d.Reset(restart)
+	if d.Failed(restart.Add(50 * time.Millisecond)) {
+		t.Error("failed right after Reset")
+	}
+	if !d.Failed(restart.Add(time.Second)) {
+		t.Error("Reset forgot the learned 100ms interval")
+	}
+}
+
+func TestFixedTimeout(t *testing.T) {
+	d := New(Policy{Kind: FixedTimeout, Threshold: 8}, time.Second, 3*time.Second)
+	now := time.Now()
+	d.Heartbeat(now)
+	if got := d.Deadline(); !got.Equal(now.Add(3 * time.Second)) {
+		t.Errorf("Deadline = last + %v, want last + 3s", got.Sub(now))
+	}
+	if s := d.Suspicion(now.Add(1500 * time.Millisecond)); s != 0.5 {
+		t.Errorf("suspicion halfway through the timeout = %v, want 0.5", s)
+	}
+	if d.Failed(now.Add(3 * time.Second)) {
+		t.Error("failed exactly at the timeout")
+	}
+	if !d.Failed(now.Add(3*time.Second + time.Millisecond)) {
+		t.Error("not failed after the timeout")
+	}
+}
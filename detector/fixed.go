@@ -0,0 +1,37 @@
+package detector
+
+import "time"
+
+// fixedTimeout fails a peer after a fixed time without heartbeat. Its
+// suspicion level is the fraction of the timeout that has elapsed.
+type fixedTimeout struct {
+	timeout time.Duration
+	last    time.Time
+}
+
+func newFixedTimeout(timeout time.Duration) Detector {
+	return &fixedTimeout{timeout: timeout, last: time.Now()}
+}
+
+func (d *fixedTimeout) Heartbeat(now time.Time) {
+	d.last = now
+}
+
+func (d *fixedTimeout) Reset(now time.Time) {
+	d.last = now
+}
+
+func (d *fixedTimeout) Suspicion(now time.Time) float64 {
+	if d.timeout <= 0 {
+		return 0
+	}
+	return float64(now.Sub(d.last)) / float64(d.timeout)
+}
+
+func (d *fixedTimeout) Failed(now time.Time) bool {
+	return now.Sub(d.last) > d.timeout
+}
+
+func (d *fixedTimeout) Deadline() time.Time {
+	return d.last.Add(d.timeout)
+}
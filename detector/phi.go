@@ -0,0 +1,113 @@
+package detector
+
+import (
+	"math"
+	"time"
+)
+
+// phiAccrual is the phi-accrual failure detector (Hayashibara et al.). It
+// models heartbeat inter-arrival times as a normal distribution fitted to the
+// last Window arrivals; phi = -log10(P(no heartbeat yet | peer alive)), so
+// phi 1 means a 10% chance that the peer is merely late, phi 8 one in 10^8.
+type phiAccrual struct {
+	threshold float64
+	minStd    float64 // Seconds
+	intervals []float64
+	next      int // Ring buffer position once intervals is full
+	window    int
+	bootstrap float64 // Expected interval in seconds, used until one is measured
+	last      time.Time
+}
+
+func newPhiAccrual(p Policy, interval time.Duration) Detector {
+	window := p.Window
+	if window < 1 {
+		window = 1
+	}
+	minStd := p.MinStdDev
+	if minStd <= 0 {
+		// Keeps phi finite when every interval is the same
+		minStd = time.Millisecond
+	}
+	return &phiAccrual{
+		threshold: p.Threshold,
+		minStd:    minStd.Seconds(),
+		window:    window,
+		bootstrap: interval.Seconds(),
+		last:      time.Now(),
+	}
+}
+
+func (d *phiAccrual) Heartbeat(now time.Time) {
+	interval := now.Sub(d.last).Seconds()
+	d.last = now
+	if interval <= 0 {
+		return
+	}
+	if len(d.intervals) < d.window {
+		d.intervals = append(d.intervals, interval)
+		return
+	}
+	d.intervals[d.next] = interval
+	d.next = (d.next + 1) % d.window
+}
+
+func (d *phiAccrual) Reset(now time.Time) {
+	d.last = now
+}
+
+// stats returns the mean and standard deviation of inter-arrival times
+func (d *phiAccrual) stats() (float64, float64) {
+	if len(d.intervals) == 0 {
+		// Same first guess as Akka: the expected interval, a quarter of it as deviation
+		return d.bootstrap, math.Max(d.bootstrap/4, d.minStd)
+	}
+	var sum float64
+	for _, v := range d.intervals {
+		sum += v
+	}
+	mean := sum / float64(len(d.intervals))
+	var sq float64
+	for _, v := range d.intervals {
+		sq += (v - mean) * (v - mean)
+	}
+	std := math.Sqrt(sq / float64(len(d.intervals)))
+	return mean, math.Max(std, d.minStd)
+}
+
+// phi is the suspicion level elapsed seconds after the last heartbeat
+func phi(elapsed, mean, std float64) float64 {
+	// P(interval > elapsed) for a normal distribution
+	p := 0.5 * math.Erfc((elapsed-mean)/(std*math.Sqrt2))
+	if p <= 0 {
+		return math.Inf(1)
+	}
+	return -math.Log10(p)
+}
+
+func (d *phiAccrual) Suspicion(now time.Time) float64 {
+	mean, std := d.stats()
+	return phi(now.Sub(d.last).Seconds(), mean, std)
+}
+
+func (d *phiAccrual) Failed(now time.Time) bool {
+	return d.Suspicion(now) >= d.threshold
+}
+
+func (d *phiAccrual) Deadline() time.Time {
+	mean, std := d.stats()
+	// phi grows with elapsed time, so bisect for where it reaches the threshold
+	lo, hi := 0.0, mean+std
+	for phi(hi, mean, std) < d.threshold {
+		hi *= 2
+	}
+	for i := 0; i < 50; i++ {
+		mid := (lo + hi) / 2
+		if phi(mid, mean, std) < d.threshold {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return d.last.Add(time.Duration(hi * float64(time.Second)))
+}
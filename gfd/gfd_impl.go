@@ -5,54 +5,64 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/wenyinh/18749-project/detector"
+	"github.com/wenyinh/18749-project/protocol"
 	"github.com/wenyinh/18749-project/utils"
 )
 
 const (
-	gfdPing = "GFD_PING"
-	gfdPong = "GFD_PONG"
+	gfdID      = "GFD"
+	subscribe  = "SUBSCRIBE"
+	membership = "MEMBERSHIP"
 )
 
 type lfdInfo struct {
 	lfdID      string
-	serverID   string
+	serverIDs  []string // Servers the LFD monitors
 	conn       net.Conn
 	reader     *bufio.Reader
 	lastHB     time.Time
+	detector   detector.Detector // Decides from GFD_PONG arrivals whether the LFD failed
 	registered bool
+	pings      int // GFD_PING sequence number
 }
 
 type gfd struct {
-	addr         string
-	membership   []string               // List of server IDs
-	memberCount  int
-	serverToLFD  map[string]string      // Map of server ID -> LFD ID
-	lfdInfos     map[string]*lfdInfo    // Map of LFD ID -> LFD info
-	hbFreq       time.Duration          // Heartbeat frequency for GFD->LFD
-	timeout      time.Duration          // Heartbeat timeout
-	mu           sync.Mutex
+	addr        string
+	membership  []string // List of server IDs
+	memberCount int
+	serverToLFD map[string]string   // Map of server ID -> LFD ID
+	lfdInfos    map[string]*lfdInfo // Map of LFD ID -> LFD info
+	subscribers map[net.Conn]string // Membership subscribers (e.g. RM) -> subscriber ID
+	hbFreq      time.Duration       // Heartbeat frequency for GFD->LFD
+	timeout     time.Duration       // Heartbeat timeout
+	detectors   detector.Policy
+	mu          sync.Mutex
 }
 
-func NewGFD(addr string, hbFreq, timeout time.Duration) GFD {
+func NewGFD(addr string, hbFreq, timeout time.Duration, detectors detector.Policy) GFD {
 	return &gfd{
 		addr:        addr,
 		membership:  make([]string, 0),
 		memberCount: 0,
 		serverToLFD: make(map[string]string),
 		lfdInfos:    make(map[string]*lfdInfo),
+		subscribers: make(map[net.Conn]string),
 		hbFreq:      hbFreq,
 		timeout:     timeout,
+		detectors:   detectors,
 	}
 }
 
 func (g *gfd) Run() error {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	listener := utils.MustListen(g.addr)
-	log.Printf("[GFD] listening on %s, heartbeat freq=%s, timeout=%s", g.addr, g.hbFreq, g.timeout)
+	log.Printf("[GFD] listening on %s, heartbeat freq=%s, timeout=%s, detector=%v", g.addr, g.hbFreq, g.timeout, g.detectors)
 
 	// Initial state
 	g.printMembership()
@@ -77,13 +87,20 @@ func (g *gfd) handleConnection(conn net.Conn) {
 	defer func() {
 		// When LFD disconnects, mark it as down
 		if lfdID != "" {
-			g.handleLFDDisconnection(lfdID)
+			g.handleLFDDisconnection(lfdID, conn)
 		}
+		g.removeSubscriber(conn)
 		_ = conn.Close()
 	}()
 
-	r := bufio.NewReader(conn)
 	log.Printf("[GFD] LFD connected from %s", conn.RemoteAddr())
+	c, err := utils.Accept(conn)
+	if err != nil {
+		return
+	}
+	// LFD and subscriber entries hold the negotiated connection
+	conn = c
+	r := bufio.NewReader(c)
 
 	for {
 		line, err := utils.ReadLine(r)
@@ -91,92 +108,177 @@ func (g *gfd) handleConnection(conn net.Conn) {
 			return
 		}
 
+		// Handle SUBSCRIBE command from a membership consumer (RM)
 		parts := strings.Fields(line)
-		if len(parts) < 1 {
+		if len(parts) == 2 && strings.ToUpper(parts[0]) == subscribe {
+			g.addSubscriber(conn, parts[1])
 			continue
 		}
 
-		command := strings.ToUpper(parts[0])
+		env, err := protocol.Decode(line)
+		if err != nil {
+			log.Printf("[GFD] unknown command: %s", line)
+			continue
+		}
 
-		// Handle REGISTER command
-		if command == "REGISTER" && len(parts) == 3 {
-			serverID := parts[1]
-			lfdID = parts[2]
+		switch env.Type {
+		case protocol.TypeRegister:
+			var reg protocol.Register
+			if err := env.Unmarshal(&reg); err != nil {
+				log.Printf("[GFD] bad REGISTER from %s: %v", conn.RemoteAddr(), err)
+				continue
+			}
+			agreed, err := reg.Handshake.Agree()
+			if err != nil {
+				log.Printf("[GFD] rejected LFD %s: %v", env.Sender, err)
+				_ = protocol.Send(conn, gfdID, 0, protocol.Nack{Reason: err.Error()})
+				return
+			}
+			serverIDs := reg.Servers()
+			if env.Sender == "" || len(serverIDs) == 0 || slices.Contains(serverIDs, "") {
+				log.Printf("[GFD] rejected REGISTER from %s: missing LFD or server ID", conn.RemoteAddr())
+				_ = protocol.Send(conn, gfdID, 0, protocol.Nack{Reason: "missing LFD or server ID"})
+				return
+			}
 
-			// Create LFD info and store connection
-			g.mu.Lock()
-			info = &lfdInfo{
-				lfdID:      lfdID,
-				serverID:   serverID,
-				conn:       conn,
-				reader:     r,
-				lastHB:     time.Now(),
-				registered: true,
+			newInfo, err := g.claimServers(conn, r, env.Sender, serverIDs)
+			if err != nil {
+				log.Printf("[GFD] rejected LFD %s: %v", env.Sender, err)
+				_ = protocol.Send(conn, gfdID, 0, protocol.Nack{Reason: err.Error()})
+				return
+			}
+			info = newInfo
+			lfdID = env.Sender
+
+			// Acknowledge before the first GFD_PING can go out
+			_ = conn.SetWriteDeadline(time.Now().Add(g.timeout))
+			err = protocol.Send(conn, gfdID, 0, protocol.Ack{Handshake: agreed})
+			_ = conn.SetWriteDeadline(time.Time{})
+			if err != nil {
+				log.Printf("[GFD] failed to acknowledge LFD %s: %v", lfdID, err)
+				return
 			}
-			g.lfdInfos[lfdID] = info
+			g.mu.Lock()
+			info.registered = true
+			info.lastHB = time.Now()
+			info.detector.Reset(info.lastHB)
 			g.mu.Unlock()
 
-			log.Printf("[GFD] LFD %s registered to monitor server %s", lfdID, serverID)
-			continue
-		}
+			log.Printf("[GFD] LFD %s registered to monitor server %s (protocol v%d, capabilities %v)",
+				lfdID, strings.Join(serverIDs, ", "), agreed.Version, agreed.Capabilities)
 
-		// Handle GFD_PONG (heartbeat response from LFD)
-		if command == "GFD_PONG" {
+		case protocol.TypeGFDPong:
+			// Heartbeat response from LFD
 			g.mu.Lock()
 			if info != nil {
 				info.lastHB = time.Now()
+				info.detector.Heartbeat(info.lastHB)
 			}
 			g.mu.Unlock()
-			continue
-		}
 
-		// Handle ADD/DELETE commands
-		// ADD can be 2 or 3 parts: "ADD S1" or "ADD S1 LFD1"
-		// DELETE should be 3 parts: "DELETE S1 LFD1"
-		if command == "ADD" && len(parts) >= 2 {
-			serverID := parts[1]
-			// If LFD ID not provided in ADD message, use the registered LFD ID
-			if len(parts) == 3 {
-				lfdID = parts[2]
+		case protocol.TypeAdd:
+			var add protocol.Add
+			if err := env.Unmarshal(&add); err != nil {
+				log.Printf("[GFD] bad ADD from %s: %v", env.Sender, err)
+				continue
 			}
-			// Only add if we have a registered LFD for this connection
-			if info != nil && info.registered {
-				g.addReplica(serverID, info.lfdID)
-			} else {
+			// Only add if we have a registered LFD for this connection, monitoring that server
+			if info == nil || !info.registered {
 				log.Printf("[GFD] received ADD from unregistered LFD, ignoring")
+			} else if !slices.Contains(info.serverIDs, add.ServerID) {
+				log.Printf("[GFD] LFD %s registered for %s sent ADD %s, ignoring",
+					info.lfdID, strings.Join(info.serverIDs, ", "), add.ServerID)
+			} else {
+				g.addReplica(add.ServerID, info.lfdID)
 			}
-		} else if command == "DELETE" && len(parts) >= 2 {
-			serverID := parts[1]
-			if len(parts) == 3 {
-				lfdID = parts[2]
-			} else if info != nil {
-				lfdID = info.lfdID
+
+		case protocol.TypeDelete:
+			var del protocol.Delete
+			if err := env.Unmarshal(&del); err != nil {
+				log.Printf("[GFD] bad DELETE from %s: %v", env.Sender, err)
+				continue
 			}
-			if lfdID != "" {
-				g.deleteReplica(serverID, lfdID)
+			// Same ownership check as ADD: an LFD may only report its own servers
+			if info == nil || !info.registered {
+				log.Printf("[GFD] received DELETE from unregistered LFD, ignoring")
+			} else if !slices.Contains(info.serverIDs, del.ServerID) {
+				log.Printf("[GFD] LFD %s registered for %s sent DELETE %s, ignoring",
+					info.lfdID, strings.Join(info.serverIDs, ", "), del.ServerID)
 			} else {
-				log.Printf("[GFD] received DELETE but cannot identify LFD")
+				g.deleteReplica(del.ServerID, info.lfdID)
 			}
-		} else if command != "ADD" && command != "DELETE" {
-			log.Printf("[GFD] unknown command: %s", command)
+
+		default:
+			log.Printf("[GFD] unknown command: %s", env.Type)
+		}
+	}
+}
+
+// claimServers reserves serverIDs for a registering LFD. A second LFD for
+// any of the same servers is rejected while the existing one answers
+// heartbeats; one that went silent is fenced off (its connection closed) and
+// replaced. The same LFD ID on another connection is a redial and replaces the
+// old entry right away, so the old one cannot time out and take the servers
+// out of the membership. The new entry is not pinged until the caller marks
+// it registered.
+func (g *gfd) claimServers(conn net.Conn, r *bufio.Reader, lfdID string, serverIDs []string) (*lfdInfo, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for id, other := range g.lfdInfos {
+		if other.conn == conn {
+			// Re-registration on the same connection replaces the old entry
+			delete(g.lfdInfos, id)
+			continue
+		}
+		shared := slices.IndexFunc(serverIDs, func(sid string) bool { return slices.Contains(other.serverIDs, sid) })
+		if id != lfdID && shared < 0 {
+			continue
+		}
+		if id == lfdID {
+			log.Printf("[GFD] LFD %s registered again from %s, fencing its old connection from %s",
+				lfdID, conn.RemoteAddr(), other.conn.RemoteAddr())
+		} else if !other.detector.Failed(time.Now()) {
+			return nil, fmt.Errorf("server %s is already monitored by LFD %s", serverIDs[shared], id)
+		} else {
+			log.Printf("[GFD] fencing LFD %s (monitoring %s): no heartbeat for %v, replaced by LFD %s",
+				id, strings.Join(other.serverIDs, ", "), time.Since(other.lastHB).Round(time.Millisecond), lfdID)
 		}
+		delete(g.lfdInfos, id)
+		_ = other.conn.Close()
 	}
+
+	info := &lfdInfo{
+		lfdID:     lfdID,
+		serverIDs: serverIDs,
+		conn:      conn,
+		reader:    r,
+		lastHB:    time.Now(),
+		detector:  detector.New(g.detectors, g.hbFreq, g.timeout),
+	}
+	g.lfdInfos[lfdID] = info
+	return info, nil
 }
 
-func (g *gfd) handleLFDDisconnection(lfdID string) {
+func (g *gfd) handleLFDDisconnection(lfdID string, conn net.Conn) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
 	info, exists := g.lfdInfos[lfdID]
+	if exists && info.conn != conn {
+		// The LFD was fenced off or registered again on a newer connection
+		log.Printf("[GFD] stale connection of LFD %s from %s closed", lfdID, conn.RemoteAddr())
+		return
+	}
 	if !exists {
 		log.Printf("[GFD] LFD %s disconnected (not registered)", lfdID)
 		return
 	}
 
-	serverID := info.serverID
 	delete(g.lfdInfos, lfdID)
 
-	log.Printf("[GFD] LFD %s disconnected (was monitoring server %s), NOT removing server from membership", lfdID, serverID)
+	log.Printf("[GFD] LFD %s disconnected (was monitoring server %s), NOT removing server from membership",
+		lfdID, strings.Join(info.serverIDs, ", "))
 }
 
 // heartbeatMonitor periodically sends heartbeats to all registered LFDs
@@ -205,57 +307,68 @@ func (g *gfd) heartbeatMonitor() {
 func (g *gfd) sendHeartbeatToLFD(info *lfdInfo) {
 	// Check if last heartbeat response is too old
 	g.mu.Lock()
-	timeSinceLastHB := time.Since(info.lastHB)
+	now := time.Now()
+	failed := info.detector.Failed(now)
+	suspicion := info.detector.Suspicion(now)
+	timeSinceLastHB := now.Sub(info.lastHB)
 	lfdID := info.lfdID
-	serverID := info.serverID
+	serverIDs := strings.Join(info.serverIDs, ", ")
 	conn := info.conn
+	info.pings++
+	seq := info.pings
 	g.mu.Unlock()
 
-	if timeSinceLastHB > g.timeout {
-		log.Printf("[GFD] LFD %s (monitoring %s) failed to respond to heartbeat (timeout=%s) <-- DETECTED LFD FAILURE",
-			lfdID, serverID, g.timeout)
+	if failed {
+		log.Printf("[GFD] LFD %s (monitoring %s) failed to respond to heartbeat (no GFD_PONG for %v, suspicion=%.2f) <-- DETECTED LFD FAILURE",
+			lfdID, serverIDs, timeSinceLastHB.Round(time.Millisecond), suspicion)
 
 		// Remove LFD from tracking and delete server from membership
-		g.handleLFDFailure(lfdID, serverID)
+		g.handleLFDFailure(info)
 		return
 	}
 
 	// Send GFD_PING
 	if conn != nil {
-		err := utils.WriteLine(conn, gfdPing)
+		err := protocol.Send(conn, gfdID, seq, protocol.GFDPing{})
 		if err != nil {
 			log.Printf("[GFD] failed to send heartbeat to LFD %s: %v", lfdID, err)
-			g.handleLFDFailure(lfdID, serverID)
+			g.handleLFDFailure(info)
 		}
 	}
 }
 
 // handleLFDFailure is called when LFD fails to respond to heartbeats
-func (g *gfd) handleLFDFailure(lfdID string, serverID string) {
+func (g *gfd) handleLFDFailure(info *lfdInfo) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
+	lfdID := info.lfdID
+	if g.lfdInfos[lfdID] != info {
+		// Already fenced off or replaced by a newer registration
+		return
+	}
 	// Remove LFD from tracking
 	delete(g.lfdInfos, lfdID)
 
-	// Remove server from membership
-	found := false
+	// Remove its servers from membership
+	var removed []string
 	newMembership := make([]string, 0, len(g.membership))
 	for _, member := range g.membership {
-		if member != serverID {
-			newMembership = append(newMembership, member)
+		if slices.Contains(info.serverIDs, member) {
+			removed = append(removed, member)
+			delete(g.serverToLFD, member)
 		} else {
-			found = true
+			newMembership = append(newMembership, member)
 		}
 	}
 
-	if found {
+	if len(removed) > 0 {
 		g.membership = newMembership
 		g.memberCount = len(g.membership)
-		delete(g.serverToLFD, serverID)
 
-		log.Printf("[GFD] removed server %s from membership due to LFD %s failure", serverID, lfdID)
+		log.Printf("[GFD] removed server %s from membership due to LFD %s failure", strings.Join(removed, ", "), lfdID)
 		g.printMembershipLocked()
+		g.publishMembershipLocked()
 	}
 }
 
@@ -279,6 +392,7 @@ func (g *gfd) addReplica(serverID string, lfdID string) {
 
 	log.Printf("[GFD] added server %s to membership (monitored by LFD %s)", serverID, lfdID)
 	g.printMembershipLocked()
+	g.publishMembershipLocked()
 }
 
 func (g *gfd) deleteReplica(serverID string, lfdID string) {
@@ -307,6 +421,47 @@ func (g *gfd) deleteReplica(serverID string, lfdID string) {
 
 	log.Printf("[GFD] deleted server %s from membership (reported by LFD %s)", serverID, lfdID)
 	g.printMembershipLocked()
+	g.publishMembershipLocked()
+}
+
+// addSubscriber registers a membership consumer and sends it the current membership
+func (g *gfd) addSubscriber(conn net.Conn, subscriberID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.subscribers[conn] = subscriberID
+	log.Printf("[GFD] %s subscribed to membership updates from %s", subscriberID, conn.RemoteAddr())
+	g.sendMembershipLocked(conn, subscriberID)
+}
+
+func (g *gfd) removeSubscriber(conn net.Conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if subscriberID, ok := g.subscribers[conn]; ok {
+		delete(g.subscribers, conn)
+		log.Printf("[GFD] subscriber %s disconnected", subscriberID)
+	}
+}
+
+// publishMembershipLocked pushes the current membership to every subscriber
+// Caller must hold g.mu
+func (g *gfd) publishMembershipLocked() {
+	for conn, subscriberID := range g.subscribers {
+		g.sendMembershipLocked(conn, subscriberID)
+	}
+}
+
+func (g *gfd) sendMembershipLocked(conn net.Conn, subscriberID string) {
+	msg := strings.TrimSpace(membership + " " + strings.Join(g.membership, " "))
+	_ = conn.SetWriteDeadline(time.Now().Add(g.timeout))
+	if err := utils.WriteLine(conn, msg); err != nil {
+		log.Printf("[GFD] failed to send membership to subscriber %s: %v (dropping)", subscriberID, err)
+		delete(g.subscribers, conn)
+		_ = conn.Close()
+		return
+	}
+	log.Printf("[GFD] sent '%s' to subscriber %s", msg, subscriberID)
 }
 
 func (g *gfd) printMembership() {
@@ -2,242 +2,184 @@ package lfd
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
+	"github.com/wenyinh/18749-project/detector"
+	"github.com/wenyinh/18749-project/protocol"
 	"github.com/wenyinh/18749-project/utils"
 )
 
-const (
-	ping     = "PING"
-	pong     = "PONG"
-	register = "REGISTER"
-	ack      = "ACK"
-	nack     = "NACK"
-	gfdPing  = "GFD_PING"
-	gfdPong  = "GFD_PONG"
-)
-
 type lfd struct {
-	lfdID          string // LFD's own ID
-	serverID       string // Server's ID that this LFD is monitoring
-	serverAddr     string
-	hbFreq         time.Duration
-	timeout        time.Duration
-	heartbeatCnt   int
-	conn           net.Conn
-	reader         *bufio.Reader
-	gfdAddr        string
-	gfdConn        net.Conn
-	gfdReader      *bufio.Reader
-	maxRetries     int
-	baseDelay      time.Duration
-	maxDelay       time.Duration
-	firstHeartbeat bool
+	lfdID      string     // LFD's own ID
+	monitors   []*monitor // One per monitored server, ordered by server ID
+	hbFreq     time.Duration
+	timeout    time.Duration
+	gfdAddr    string
+	gfdMu      sync.Mutex // Guards gfdConn, gfdReader and reported
+	gfdConn    net.Conn
+	gfdReader  *bufio.Reader
+	reported   map[string]protocol.Message // Last ADD or DELETE per server, repeated after re-registering with GFD
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	sup        Supervision
+	detectors  detector.Policy
+	err        error // Configuration error reported by Run
 }
 
-func getServerID(lfdID string) string {
-	if lfdID[:3] != "LFD" {
+// DefaultServerID derives the monitored server from an LFD<n> ID (LFD1 -> S1)
+func DefaultServerID(lfdID string) string {
+	suffix, ok := strings.CutPrefix(lfdID, "LFD")
+	if !ok || suffix == "" {
 		return ""
 	}
-	return "S" + lfdID[3:]
+	return "S" + suffix
 }
 
-func NewLFD(lfdID, serverAddr, gfdAddr string, hbFreq, timeout time.Duration, maxRetries int, baseDelay, maxDelay time.Duration) LFD {
-	return &lfd{
-		lfdID:          lfdID,              // LFD's own ID
-		serverID:       getServerID(lfdID), // Server ID to monitor
-		serverAddr:     serverAddr,
-		hbFreq:         hbFreq,
-		timeout:        timeout,
-		gfdAddr:        gfdAddr,
-		maxRetries:     maxRetries,
-		baseDelay:      baseDelay,
-		maxDelay:       maxDelay,
-		firstHeartbeat: true,
+// checkID rejects IDs that cannot be sent in space-separated messages such as MEMBERSHIP
+func checkID(kind, id string) error {
+	if id == "" {
+		return fmt.Errorf("%s ID is empty", kind)
 	}
-}
-
-func (l *lfd) Run() error {
-	log.Printf("[LFD][%s] starting; monitoring server=%s at %s freq=%s timeout=%s",
-		l.lfdID, l.serverID, l.serverAddr, l.hbFreq, l.timeout)
-
-	// Connect to GFD first (GFD should be running)
-	if err := l.connectToGFD(); err != nil {
-		log.Printf("[LFD][%s] failed to connect to GFD at %s: %v", l.lfdID, l.gfdAddr, err)
-		return err
+	if strings.ContainsFunc(id, unicode.IsSpace) {
+		return fmt.Errorf("%s ID %q contains whitespace", kind, id)
 	}
-
-	log.Printf("[LFD][%s] registered with GFD, waiting for server %s to start...", l.lfdID, l.serverID)
-
-	// Don't exit if server is not running yet - keep trying in heartbeat loop
-	// Server will be started later by the user
-
-	// Start heartbeat loop - will continuously try to connect to server
-	t := time.NewTicker(l.hbFreq)
-	defer t.Stop()
-
-	for range t.C {
-		l.sendOneHeartbeat()
-	}
-
 	return nil
 }
 
-func (l *lfd) sendOneHeartbeat() {
-	if l.conn == nil {
-		if err := l.connectWithRetry(); err != nil {
-			// If we never had a successful connection (firstHeartbeat == true),
-			// then server hasn't started yet - just keep waiting
-			if l.firstHeartbeat {
-				log.Printf("[LFD][%s] server %s not available yet, waiting...", l.lfdID, l.serverID)
-				return
-			}
-			// If we HAD a connection before, this is a real failure
-			log.Printf("[LFD][%s] connect failed after retries; server %s appears to be down", l.lfdID, l.serverID)
-			l.notifyGFD("DELETE")
-			fmt.Printf("SERVER %s DOWN\n", l.serverID)
-			os.Exit(0)
-		}
+// NewLFD creates an LFD for the local servers in servers (server ID ->
+// address). Supervision is only possible for a single server. Invalid IDs
+// make Run fail.
+func NewLFD(lfdID string, servers map[string]string, gfdAddr string, hbFreq, timeout time.Duration, maxRetries int, baseDelay, maxDelay time.Duration, sup Supervision, detectors detector.Policy) LFD {
+	ids := make([]string, 0, len(servers))
+	for id := range servers {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
 
-	l.heartbeatCnt++
-
-	// Send PING
-	_ = l.conn.SetWriteDeadline(time.Now().Add(l.timeout))
-	hb := ping
-	if err := utils.WriteLine(l.conn, hb); err != nil {
-		log.Printf("[%s] [heartbeat_count=%d] HEARTBEAT SEND FAILED to %s: %v",
-			l.lfdTag(), l.heartbeatCnt, l.serverAddr, err)
-		l.resetConn()
-
-		// Try to reconnect
-		if err := l.connectWithRetry(); err != nil {
-			log.Printf("[%s] [heartbeat_count=%d] Reconnection failed after retries  <-- DETECTED CRASH",
-				l.lfdTag(), l.heartbeatCnt)
-			l.notifyGFD("DELETE")
-			fmt.Printf("SERVER %s DOWN\n", l.serverID)
-			os.Exit(0)
+	err := checkID("LFD", lfdID)
+	if err == nil && len(ids) == 0 {
+		err = errors.New("no server to monitor")
+	}
+	for _, id := range ids {
+		if err == nil {
+			err = checkID("server", id)
+		}
+		if err == nil && servers[id] == "" {
+			err = fmt.Errorf("server %s has no address", id)
 		}
-		return
 	}
-	cyan := "\033[36m"
-	reset := "\033[0m"
-	log.Printf("%s[%s] [heartbeat_count=%d] LFD->S send heartbeat: '%s'%s",
-		cyan, l.lfdTag(), l.heartbeatCnt, hb, reset)
-
-	// Expect PONG
-	_ = l.conn.SetReadDeadline(time.Now().Add(l.timeout))
-	line, err := utils.ReadLine(l.reader)
+	if err == nil && len(sup.Command) > 0 && len(ids) > 1 {
+		err = errors.New("supervisor mode runs a single server")
+	}
 	if err != nil {
-		log.Printf("[%s] [heartbeat_count=%d] HEARTBEAT RECV FAILED from server %s: %v",
-			l.lfdTag(), l.heartbeatCnt, l.serverID, err)
-		l.resetConn()
-
-		// Try to reconnect
-		if err := l.connectWithRetry(); err != nil {
-			log.Printf("[%s] [heartbeat_count=%d] Reconnection failed after retries  <-- DETECTED CRASH",
-				l.lfdTag(), l.heartbeatCnt)
-			l.notifyGFD("DELETE")
-			fmt.Printf("SERVER %s DOWN\n", l.serverID)
-			os.Exit(0)
-		}
-		return
+		err = fmt.Errorf("invalid LFD configuration: %w (check -id, -server-id and -servers)", err)
 	}
 
-	if line == pong {
-		log.Printf("%s[%s] [heartbeat_count=%d] S->LFD recv heartbeat reply: '%s'%s",
-			cyan, l.lfdTag(), l.heartbeatCnt, line, reset)
-
-		// If this is the first successful heartbeat, notify GFD
-		if l.firstHeartbeat {
-			l.firstHeartbeat = false
-			l.notifyGFD("ADD")
-		}
-	} else {
-		log.Printf("[%s] [heartbeat_count=%d] UNEXPECTED REPLY '%s' (expected PONG)",
-			l.lfdTag(), l.heartbeatCnt, line)
-		l.resetConn()
-
-		// Try to reconnect
-		if err := l.connectWithRetry(); err != nil {
-			log.Printf("[%s] [heartbeat_count=%d] Reconnection failed after retries  <-- DETECTED CRASH",
-				l.lfdTag(), l.heartbeatCnt)
-			l.notifyGFD("DELETE")
-			fmt.Printf("SERVER %s DOWN\n", l.serverID)
-			os.Exit(0)
-		}
+	l := &lfd{
+		lfdID:      lfdID, // LFD's own ID
+		hbFreq:     hbFreq,
+		timeout:    timeout,
+		gfdAddr:    gfdAddr,
+		reported:   make(map[string]protocol.Message),
+		maxRetries: maxRetries,
+		baseDelay:  baseDelay,
+		maxDelay:   maxDelay,
+		sup:        sup,
+		detectors:  detectors,
+		err:        err,
+	}
+	for _, id := range ids {
+		l.monitors = append(l.monitors, &monitor{
+			lfd:        l,
+			serverID:   id,
+			serverAddr: servers[id],
+			exited:     make(chan procExit, 1),
+			detector:   detector.New(detectors, hbFreq, timeout),
+		})
 	}
+	return l
 }
 
-func (l *lfd) connect() error {
-	log.Printf("[LFD][%s] connecting to %s to monitor server %s ...", l.lfdID, l.serverAddr, l.serverID)
-	conn, err := net.Dial("tcp", l.serverAddr)
-	if err != nil {
-		log.Printf("[LFD][%s] connection to %s failed: %v", l.lfdID, l.serverAddr, err)
-		return err
+// serverIDs lists the monitored servers in order
+func (l *lfd) serverIDs() []string {
+	ids := make([]string, len(l.monitors))
+	for i, m := range l.monitors {
+		ids[i] = m.serverID
 	}
-	l.conn = conn
-	l.reader = bufio.NewReader(l.conn)
+	return ids
+}
 
-	// Send REGISTER handshake with server ID
-	log.Printf("[LFD][%s] sending registration for server %s", l.lfdID, l.serverID)
-	_ = l.conn.SetWriteDeadline(time.Now().Add(l.timeout))
-	registerMsg := fmt.Sprintf("%s %s", register, l.serverID)
-	if err := utils.WriteLine(l.conn, registerMsg); err != nil {
-		log.Printf("[LFD][%s] failed to send registration: %v", l.lfdID, err)
-		_ = l.conn.Close()
-		l.conn = nil
-		l.reader = nil
-		return err
+func (l *lfd) Run() error {
+	if l.err != nil {
+		return l.err
 	}
-
-	// Wait for ACK or NACK
-	_ = l.conn.SetReadDeadline(time.Now().Add(l.timeout))
-	response, err := utils.ReadLine(l.reader)
-	if err != nil {
-		log.Printf("[LFD][%s] failed to receive registration response: %v", l.lfdID, err)
-		_ = l.conn.Close()
-		l.conn = nil
-		l.reader = nil
-		return err
+	for _, m := range l.monitors {
+		log.Printf("[LFD][%s] starting; monitoring server=%s at %s freq=%s timeout=%s detector=%v",
+			l.lfdID, m.serverID, m.serverAddr, l.hbFreq, l.timeout, l.detectors)
 	}
 
-	if response != ack {
-		log.Printf("[LFD][%s] server rejected registration with response: %s", l.lfdID, response)
-		_ = l.conn.Close()
-		l.conn = nil
-		l.reader = nil
-		return fmt.Errorf("server rejected registration: expected server ID %s", l.serverID)
+	// Connect to GFD first (GFD should be running)
+	if err := l.connectToGFD(); err != nil {
+		log.Printf("[LFD][%s] failed to connect to GFD at %s: %v", l.lfdID, l.gfdAddr, err)
+		return err
 	}
 
-	log.Printf("[LFD][%s] successfully registered to monitor server %s at %s", l.lfdID, l.serverID, l.serverAddr)
-	return nil
-}
+	// Answer GFD heartbeats and re-register whenever GFD goes away
+	go l.watchGFD()
 
-func (l *lfd) connectWithRetry() error {
-	for attempt := 0; attempt <= l.maxRetries; attempt++ {
-		err := l.connect()
-		if err == nil {
-			return nil
-		}
-
-		if attempt == l.maxRetries {
-			log.Printf("[LFD][%s] Failed to connect to server %s after %d attempts", l.lfdID, l.serverID, l.maxRetries+1)
+	var stop chan os.Signal
+	if l.supervising() {
+		m := l.monitors[0]
+		log.Printf("[LFD][%s] supervising server %s (%v)", l.lfdID, m.serverID, l.sup)
+		if err := m.startServer(); err != nil {
 			return err
 		}
+		// Take the server down with us
+		stop = make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	} else {
+		// Don't exit if servers are not running yet - keep trying in heartbeat loops
+		// Servers will be started later by the user
+		log.Printf("[LFD][%s] registered with GFD, waiting for server %s to start...",
+			l.lfdID, strings.Join(l.serverIDs(), ", "))
+	}
 
-		delay := l.calculateBackoffDelay(attempt)
-		log.Printf("[LFD][%s] Retry %d/%d: reconnecting to server %s in %v...", l.lfdID, attempt+1, l.maxRetries, l.serverID, delay)
-		time.Sleep(delay)
+	// Start one heartbeat loop per server - each will continuously try to connect to its server
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, m := range l.monitors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.run(quit)
+		}()
 	}
-	return fmt.Errorf("max retries exceeded")
+
+	if stop != nil {
+		sig := <-stop
+		log.Printf("[LFD][%s] received %v, shutting down", l.lfdID, sig)
+		close(quit)
+	}
+	wg.Wait()
+	return nil
 }
 
 func (l *lfd) calculateBackoffDelay(attempt int) time.Duration {
+	if attempt > 16 {
+		attempt = 16
+	}
 	delay := time.Duration(1<<uint(attempt)) * l.baseDelay
 	if delay > l.maxDelay {
 		delay = l.maxDelay
@@ -247,87 +189,172 @@ func (l *lfd) calculateBackoffDelay(attempt int) time.Duration {
 
 func (l *lfd) connectToGFD() error {
 	log.Printf("[LFD][%s] connecting to GFD at %s ...", l.lfdID, l.gfdAddr)
-	conn, err := net.Dial("tcp", l.gfdAddr)
+	conn, err := utils.Dial(l.gfdAddr, 0)
 	if err != nil {
 		log.Printf("[LFD][%s] failed to connect to GFD: %v", l.lfdID, err)
 		return err
 	}
-	l.gfdConn = conn
-	l.gfdReader = bufio.NewReader(conn)
+	reader := bufio.NewReader(conn)
 
 	// Send REGISTER message to GFD
-	registerMsg := fmt.Sprintf("REGISTER %s %s", l.serverID, l.lfdID)
-	err = utils.WriteLine(l.gfdConn, registerMsg)
+	ids := l.serverIDs()
+	reg := protocol.Register{ServerID: ids[0], Handshake: protocol.Offer()}
+	if len(ids) > 1 {
+		reg.ServerIDs = ids
+	}
+	err = protocol.Send(conn, l.lfdID, 0, reg)
 	if err != nil {
 		log.Printf("[LFD][%s] failed to register with GFD: %v", l.lfdID, err)
-		_ = l.gfdConn.Close()
-		l.gfdConn = nil
-		l.gfdReader = nil
+		_ = conn.Close()
 		return err
 	}
 
-	log.Printf("[LFD][%s] registered with GFD to monitor server %s", l.lfdID, l.serverID)
+	// Wait for ACK or NACK
+	agreed, err := l.awaitGFDAck(conn, reader)
+	if err == nil && len(ids) > 1 && !agreed.Has(protocol.CapMultiServer) {
+		err = errors.New("GFD does not accept several servers per LFD")
+	}
+	if err != nil {
+		log.Printf("[LFD][%s] GFD registration failed: %v", l.lfdID, err)
+		_ = conn.Close()
+		return err
+	}
 
-	// Start goroutine to handle GFD heartbeats
-	go l.handleGFDHeartbeats()
+	log.Printf("[LFD][%s] registered with GFD to monitor server %s (protocol v%d, capabilities %v)",
+		l.lfdID, strings.Join(ids, ", "), agreed.Version, agreed.Capabilities)
 
+	l.gfdMu.Lock()
+	defer l.gfdMu.Unlock()
+	l.gfdConn = conn
+	l.gfdReader = reader
+	// Tell a restarted GFD what it missed so membership is rebuilt
+	for _, id := range ids {
+		if msg, ok := l.reported[id]; ok {
+			l.sendToGFDLocked(id, msg)
+		}
+	}
 	return nil
 }
 
-func (l *lfd) handleGFDHeartbeats() {
-	log.Printf("[LFD][%s] starting GFD heartbeat handler", l.lfdID)
+// awaitGFDAck reads GFD's answer to REGISTER and returns the agreed protocol
+func (l *lfd) awaitGFDAck(conn net.Conn, reader *bufio.Reader) (protocol.Handshake, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(l.timeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+	line, err := utils.ReadLine(reader)
+	if err != nil {
+		return protocol.Handshake{}, fmt.Errorf("no reply to REGISTER: %w", err)
+	}
+	env, err := protocol.Decode(line)
+	if err != nil {
+		return protocol.Handshake{}, fmt.Errorf("unexpected reply to REGISTER: %s", line)
+	}
+	switch env.Type {
+	case protocol.TypeAck:
+		// Check GFD picked a version we support
+		var ackMsg protocol.Ack
+		if err := env.Unmarshal(&ackMsg); err != nil {
+			return protocol.Handshake{}, err
+		}
+		return ackMsg.Handshake.Agree()
+	case protocol.TypeNack:
+		var nack protocol.Nack
+		_ = env.Unmarshal(&nack)
+		return protocol.Handshake{}, fmt.Errorf("GFD rejected registration: %s", nack.Reason)
+	default:
+		return protocol.Handshake{}, fmt.Errorf("unexpected reply to REGISTER: %s", line)
+	}
+}
+
+// watchGFD answers GFD heartbeats and, when the connection drops, reconnects
+// with backoff and registers again
+func (l *lfd) watchGFD() {
 	for {
-		if l.gfdReader == nil || l.gfdConn == nil {
-			log.Printf("[LFD][%s] GFD connection lost, stopping heartbeat handler", l.lfdID)
-			return
+		l.handleGFDHeartbeats()
+		l.resetGFDConn()
+		for attempt := 0; ; attempt++ {
+			delay := l.calculateBackoffDelay(attempt)
+			log.Printf("[LFD][%s] reconnecting to GFD at %s in %v...", l.lfdID, l.gfdAddr, delay)
+			time.Sleep(delay)
+			if err := l.connectToGFD(); err == nil {
+				break
+			}
 		}
+	}
+}
+
+// handleGFDHeartbeats answers GFD_PING until the GFD connection is lost
+func (l *lfd) handleGFDHeartbeats() {
+	l.gfdMu.Lock()
+	conn, reader := l.gfdConn, l.gfdReader
+	l.gfdMu.Unlock()
+	if conn == nil || reader == nil {
+		return
+	}
 
+	log.Printf("[LFD][%s] starting GFD heartbeat handler", l.lfdID)
+	for {
 		// Read message from GFD (blocking)
-		line, err := utils.ReadLine(l.gfdReader)
+		line, err := utils.ReadLine(reader)
 		if err != nil {
 			log.Printf("[LFD][%s] GFD connection closed: %v", l.lfdID, err)
 			return
 		}
 
-		// Handle GFD_PING
-		if line == gfdPing {
+		env, err := protocol.Decode(line)
+		if err != nil {
+			log.Printf("[LFD][%s] received unexpected message from GFD: %s", l.lfdID, line)
+			continue
+		}
+		switch env.Type {
+		case protocol.TypeGFDPing:
 			// Respond with GFD_PONG
-			err := utils.WriteLine(l.gfdConn, gfdPong)
+			err := protocol.Send(conn, l.lfdID, env.Seq, protocol.GFDPong{})
 			if err != nil {
 				log.Printf("[LFD][%s] failed to send GFD_PONG: %v", l.lfdID, err)
 				return
 			}
 			log.Printf("[LFD][%s] responded to GFD heartbeat with GFD_PONG", l.lfdID)
-		} else {
+		default:
 			log.Printf("[LFD][%s] received unexpected message from GFD: %s", l.lfdID, line)
 		}
 	}
 }
 
-func (l *lfd) notifyGFD(action string) {
+// notifyGFD reports an ADD or DELETE for a server. Without a GFD connection
+// the report is kept and sent once the LFD has registered again.
+func (l *lfd) notifyGFD(serverID string, msg protocol.Message) {
+	l.gfdMu.Lock()
+	defer l.gfdMu.Unlock()
+	l.reported[serverID] = msg
 	if l.gfdConn == nil {
-		log.Printf("[LFD][%s] no GFD connection, skipping %s notification for server %s", l.lfdID, action, l.serverID)
+		log.Printf("[LFD][%s] no GFD connection, deferring %s notification for server %s", l.lfdID, msg.MessageType(), serverID)
 		return
 	}
+	l.sendToGFDLocked(serverID, msg)
+}
 
-	// Send server ID to GFD, not LFD ID
-	msg := fmt.Sprintf("%s %s %s", action, l.serverID, l.lfdID)
-	err := utils.WriteLine(l.gfdConn, msg)
+// sendToGFDLocked writes msg about serverID to GFD
+// Caller must hold l.gfdMu
+func (l *lfd) sendToGFDLocked(serverID string, msg protocol.Message) {
+	action := msg.MessageType()
+	_ = l.gfdConn.SetWriteDeadline(time.Now().Add(l.timeout))
+	err := protocol.Send(l.gfdConn, l.lfdID, 0, msg)
+	_ = l.gfdConn.SetWriteDeadline(time.Time{})
 	if err != nil {
-		log.Printf("[LFD][%s] failed to send %s for server %s to GFD: %v", l.lfdID, action, l.serverID, err)
+		log.Printf("[LFD][%s] failed to send %s for server %s to GFD: %v", l.lfdID, action, serverID, err)
 	} else {
-		log.Printf("[LFD][%s] sent %s for server %s to GFD", l.lfdID, action, l.serverID)
+		log.Printf("[LFD][%s] sent %s for server %s to GFD", l.lfdID, action, serverID)
 	}
 }
 
-func (l *lfd) resetConn() {
-	if l.conn != nil {
-		_ = l.conn.Close()
+func (l *lfd) resetGFDConn() {
+	l.gfdMu.Lock()
+	defer l.gfdMu.Unlock()
+	if l.gfdConn != nil {
+		_ = l.gfdConn.Close()
 	}
-	l.conn = nil
-	l.reader = nil
-}
-
-func (l *lfd) lfdTag() string {
-	return fmt.Sprintf("LFD][%s->%s", l.lfdID, l.serverID)
+	l.gfdConn = nil
+	l.gfdReader = nil
 }
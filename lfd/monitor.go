@@ -0,0 +1,252 @@
+package lfd
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"time"
+
+	"github.com/wenyinh/18749-project/detector"
+	"github.com/wenyinh/18749-project/protocol"
+	"github.com/wenyinh/18749-project/utils"
+)
+
+// monitor heartbeats one local server on behalf of its LFD
+type monitor struct {
+	*lfd
+	serverID     string // ID of the monitored server
+	serverAddr   string
+	heartbeatCnt int
+	conn         net.Conn
+	reader       *bufio.Reader
+	serverAlive  bool               // Server answered PONG since the last DELETE; ADD was sent
+	probes       int                // Failed probes of a server that is down
+	nextProbe    time.Time          // When to probe a down server again
+	serverProto  protocol.Handshake // Version and capabilities agreed with the server
+	detector     detector.Detector  // Decides from PONG arrivals whether the server failed
+	proc         *exec.Cmd          // Supervised server process, nil while it is not running
+	exited       chan procExit      // Wait status of the supervised server
+	restarts     int                // Restarts in a row without the server answering a heartbeat
+}
+
+// run heartbeats the server every hbFreq until quit is closed
+func (m *monitor) run(quit <-chan struct{}) {
+	t := time.NewTicker(m.hbFreq)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			m.sendOneHeartbeat()
+		case exit := <-m.exited:
+			m.serverExited(exit)
+		case <-quit:
+			m.stopServer()
+			return
+		}
+	}
+}
+
+func (m *monitor) sendOneHeartbeat() {
+	if m.conn == nil && !m.probeServer() {
+		return
+	}
+
+	m.heartbeatCnt++
+
+	// Send PING
+	_ = m.conn.SetWriteDeadline(time.Now().Add(m.timeout))
+	hb := protocol.TypePing
+	if err := protocol.Send(m.conn, m.lfdID, m.heartbeatCnt, protocol.Ping{}); err != nil {
+		log.Printf("[%s] [heartbeat_count=%d] HEARTBEAT SEND FAILED to %s: %v",
+			m.lfdTag(), m.heartbeatCnt, m.serverAddr, err)
+		m.reconnectOrFail()
+		return
+	}
+	cyan := "\033[36m"
+	reset := "\033[0m"
+	log.Printf("%s[%s] [heartbeat_count=%d] LFD->S send heartbeat: '%s'%s",
+		cyan, m.lfdTag(), m.heartbeatCnt, hb, reset)
+
+	// Expect PONG before the failure detector gives up on the server
+	_ = m.conn.SetReadDeadline(m.pongDeadline())
+	line, err := utils.ReadLine(m.reader)
+	if err != nil {
+		log.Printf("[%s] [heartbeat_count=%d] HEARTBEAT RECV FAILED from server %s: %v (suspicion=%.2f)",
+			m.lfdTag(), m.heartbeatCnt, m.serverID, err, m.detector.Suspicion(time.Now()))
+		m.reconnectOrFail()
+		return
+	}
+
+	if m.isPong(line) {
+		now := time.Now()
+		suspicion := m.detector.Suspicion(now)
+		m.detector.Heartbeat(now)
+		log.Printf("%s[%s] [heartbeat_count=%d] S->LFD recv heartbeat reply: '%s' (suspicion=%.2f)%s",
+			cyan, m.lfdTag(), m.heartbeatCnt, protocol.TypePong, suspicion, reset)
+
+		// Server is (back) up, notify GFD
+		if !m.serverAlive {
+			m.serverAlive = true
+			m.restarts = 0
+			m.notifyGFD(m.serverID, protocol.Add{ServerID: m.serverID})
+		}
+	} else {
+		log.Printf("[%s] [heartbeat_count=%d] UNEXPECTED REPLY '%s' (expected PONG)",
+			m.lfdTag(), m.heartbeatCnt, line)
+		m.reconnectOrFail()
+	}
+}
+
+// pongDeadline is how long to wait for the PONG to a ping sent now. The fixed
+// timeout detector allows -timeout per ping, as before detectors existed;
+// phi-accrual waits until phi reaches the threshold.
+func (m *monitor) pongDeadline() time.Time {
+	if m.detectors.Kind == detector.FixedTimeout {
+		return time.Now().Add(m.timeout)
+	}
+	return m.detector.Deadline()
+}
+
+// reconnectOrFail drops the server connection and retries it; if the
+// retries fail the server is reported down
+func (m *monitor) reconnectOrFail() {
+	m.resetConn()
+	if err := m.connectWithRetry(); err == nil {
+		return
+	}
+	if !m.serverAlive {
+		return
+	}
+	log.Printf("[%s] [heartbeat_count=%d] Reconnection failed after retries  <-- DETECTED CRASH",
+		m.lfdTag(), m.heartbeatCnt)
+	m.serverAlive = false
+	m.notifyGFD(m.serverID, protocol.Delete{ServerID: m.serverID})
+	fmt.Printf("SERVER %s DOWN\n", m.serverID)
+	// A supervised server that hangs is restarted once its process is gone
+	m.killServer()
+}
+
+// probeServer tries to connect to a server that is down or not started yet,
+// backing off between attempts up to maxDelay. It reports whether the
+// connection is open.
+func (m *monitor) probeServer() bool {
+	if time.Now().Before(m.nextProbe) {
+		return false
+	}
+	if err := m.connect(); err != nil {
+		delay := m.calculateBackoffDelay(m.probes)
+		m.probes++
+		m.nextProbe = time.Now().Add(delay)
+		log.Printf("[LFD][%s] server %s not available, probing again in %v", m.lfdID, m.serverID, delay)
+		return false
+	}
+	m.probes = 0
+	m.nextProbe = time.Time{}
+	return true
+}
+
+func (m *monitor) connect() error {
+	log.Printf("[LFD][%s] connecting to %s to monitor server %s ...", m.lfdID, m.serverAddr, m.serverID)
+	conn, err := utils.Dial(m.serverAddr, 0)
+	if err != nil {
+		log.Printf("[LFD][%s] connection to %s failed: %v", m.lfdID, m.serverAddr, err)
+		return err
+	}
+	m.conn = conn
+	m.reader = bufio.NewReader(m.conn)
+
+	// Send REGISTER handshake with server ID
+	log.Printf("[LFD][%s] sending registration for server %s", m.lfdID, m.serverID)
+	_ = m.conn.SetWriteDeadline(time.Now().Add(m.timeout))
+	if err := protocol.Send(m.conn, m.lfdID, 0, protocol.Register{ServerID: m.serverID, Handshake: protocol.Offer()}); err != nil {
+		log.Printf("[LFD][%s] failed to send registration: %v", m.lfdID, err)
+		_ = m.conn.Close()
+		m.conn = nil
+		m.reader = nil
+		return err
+	}
+
+	// Wait for ACK or NACK
+	_ = m.conn.SetReadDeadline(time.Now().Add(m.timeout))
+	response, err := utils.ReadLine(m.reader)
+	if err != nil {
+		log.Printf("[LFD][%s] failed to receive registration response: %v", m.lfdID, err)
+		_ = m.conn.Close()
+		m.conn = nil
+		m.reader = nil
+		return err
+	}
+
+	env, err := protocol.Decode(response)
+	if err != nil || env.Type != protocol.TypeAck {
+		log.Printf("[LFD][%s] server rejected registration with response: %s", m.lfdID, response)
+		_ = m.conn.Close()
+		m.conn = nil
+		m.reader = nil
+		var nack protocol.Nack
+		if err == nil && env.Unmarshal(&nack) == nil && nack.Reason != "" {
+			return fmt.Errorf("server rejected registration for %s: %s", m.serverID, nack.Reason)
+		}
+		return fmt.Errorf("server rejected registration: expected server ID %s", m.serverID)
+	}
+	// Check the server picked a version and capabilities we support
+	var ackMsg protocol.Ack
+	var agreed protocol.Handshake
+	if err = env.Unmarshal(&ackMsg); err == nil {
+		agreed, err = ackMsg.Handshake.Agree()
+	}
+	if err != nil {
+		log.Printf("[LFD][%s] cannot talk to server %s: %v", m.lfdID, m.serverID, err)
+		m.resetConn()
+		return err
+	}
+	m.serverProto = agreed
+	m.detector.Reset(time.Now())
+
+	log.Printf("[LFD][%s] successfully registered to monitor server %s at %s (protocol v%d, capabilities %v)",
+		m.lfdID, m.serverID, m.serverAddr, agreed.Version, agreed.Capabilities)
+	return nil
+}
+
+func (m *monitor) connectWithRetry() error {
+	for attempt := 0; attempt <= m.maxRetries; attempt++ {
+		err := m.connect()
+		if err == nil {
+			return nil
+		}
+
+		if attempt == m.maxRetries {
+			log.Printf("[LFD][%s] Failed to connect to server %s after %d attempts", m.lfdID, m.serverID, m.maxRetries+1)
+			return err
+		}
+
+		delay := m.calculateBackoffDelay(attempt)
+		log.Printf("[LFD][%s] Retry %d/%d: reconnecting to server %s in %v...", m.lfdID, attempt+1, m.maxRetries, m.serverID, delay)
+		time.Sleep(delay)
+	}
+	return fmt.Errorf("max retries exceeded")
+}
+
+// isPong reports whether line is the monitored server's answer to the current heartbeat
+func (m *monitor) isPong(line string) bool {
+	env, err := protocol.Decode(line)
+	if err != nil || env.Type != protocol.TypePong || env.Sender != m.serverID {
+		return false
+	}
+	return !m.serverProto.Has(protocol.CapHeartbeatSeq) || env.Seq == m.heartbeatCnt
+}
+
+func (m *monitor) resetConn() {
+	if m.conn != nil {
+		_ = m.conn.Close()
+	}
+	m.conn = nil
+	m.reader = nil
+}
+
+func (m *monitor) lfdTag() string {
+	return fmt.Sprintf("LFD][%s->%s", m.lfdID, m.serverID)
+}
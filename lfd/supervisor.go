@@ -0,0 +1,166 @@
+package lfd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/wenyinh/18749-project/protocol"
+)
+
+// RestartMode says when a supervised server is started again
+type RestartMode int
+
+const (
+	RestartOnFailure RestartMode = iota // after a non-zero exit, a signal or missed heartbeats
+	RestartAlways                       // also after a clean exit
+	RestartNever                        // report the failure and leave the server down
+)
+
+func (m RestartMode) String() string {
+	switch m {
+	case RestartOnFailure:
+		return "on-failure"
+	case RestartAlways:
+		return "always"
+	default:
+		return "never"
+	}
+}
+
+// Supervision makes LFD launch the server it monitors as a child process and
+// restart it according to Restart. The delay before a restart starts at
+// RestartDelay and doubles with every restart in a row, up to the LFD's max
+// backoff delay; after MaxRestarts restarts in a row (0 = unlimited) without
+// the server answering a heartbeat, LFD gives up and leaves it down.
+type Supervision struct {
+	Command      []string // Server command line; empty disables supervision
+	Restart      RestartMode
+	MaxRestarts  int
+	RestartDelay time.Duration
+}
+
+func (s Supervision) String() string {
+	return fmt.Sprintf("restart=%v max_restarts=%d restart_delay=%v", s.Restart, s.MaxRestarts, s.RestartDelay)
+}
+
+// procExit is the wait status of a supervised server
+type procExit struct {
+	pid int
+	err error
+}
+
+func (l *lfd) supervising() bool {
+	return len(l.sup.Command) > 0
+}
+
+// startServer launches the server command; its exit is delivered on m.exited
+func (m *monitor) startServer() error {
+	cmd := exec.Command(m.sup.Command[0], m.sup.Command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start server %s: %w", m.serverID, err)
+	}
+	m.proc = cmd
+	log.Printf("[LFD][%s] started server %s (pid %d): %v", m.lfdID, m.serverID, cmd.Process.Pid, m.sup.Command)
+
+	// Connect as soon as the new process listens
+	m.probes = 0
+	m.nextProbe = time.Time{}
+
+	go func() {
+		err := cmd.Wait()
+		m.exited <- procExit{pid: cmd.Process.Pid, err: err}
+	}()
+	return nil
+}
+
+// killServer stops a supervised server that no longer answers heartbeats;
+// its exit is then handled like any other
+func (m *monitor) killServer() {
+	if m.proc == nil {
+		return
+	}
+	log.Printf("[LFD][%s] killing unresponsive server %s (pid %d)", m.lfdID, m.serverID, m.proc.Process.Pid)
+	_ = m.proc.Process.Kill()
+}
+
+// serverExited reports the server down and restarts it if the policy says so
+func (m *monitor) serverExited(exit procExit) {
+	m.proc = nil
+	m.resetConn()
+	status := "exited cleanly"
+	if exit.err != nil {
+		status = exit.err.Error()
+	}
+	log.Printf("[LFD][%s] server %s (pid %d) %s  <-- DETECTED CRASH", m.lfdID, m.serverID, exit.pid, status)
+	if m.serverAlive {
+		m.serverAlive = false
+		m.notifyGFD(m.serverID, protocol.Delete{ServerID: m.serverID})
+		fmt.Printf("SERVER %s DOWN\n", m.serverID)
+	}
+
+	switch {
+	case m.sup.Restart == RestartNever:
+		log.Printf("[LFD][%s] restart policy is %v, leaving server %s down", m.lfdID, m.sup.Restart, m.serverID)
+	case m.sup.Restart == RestartOnFailure && exit.err == nil:
+		log.Printf("[LFD][%s] server %s exited cleanly, not restarting (restart policy %v)", m.lfdID, m.serverID, m.sup.Restart)
+	default:
+		m.restartServer()
+	}
+}
+
+// restartServer starts the server again after the restart delay, retrying
+// until it starts or MaxRestarts is reached
+func (m *monitor) restartServer() {
+	for {
+		if m.sup.MaxRestarts > 0 && m.restarts >= m.sup.MaxRestarts {
+			log.Printf("[LFD][%s] server %s restarted %d times in a row without coming up, giving up",
+				m.lfdID, m.serverID, m.restarts)
+			return
+		}
+		delay := m.restartDelay(m.restarts)
+		m.restarts++
+		log.Printf("[LFD][%s] restarting server %s in %v (restart %d)", m.lfdID, m.serverID, delay, m.restarts)
+		time.Sleep(delay)
+		err := m.startServer()
+		if err == nil {
+			return
+		}
+		log.Printf("[LFD][%s] %v", m.lfdID, err)
+	}
+}
+
+func (m *monitor) restartDelay(restarts int) time.Duration {
+	if restarts > 16 {
+		restarts = 16
+	}
+	delay := time.Duration(1<<uint(restarts)) * m.sup.RestartDelay
+	if delay > m.maxDelay {
+		delay = m.maxDelay
+	}
+	return delay
+}
+
+// stopServer terminates a supervised server when LFD shuts down
+func (m *monitor) stopServer() {
+	if m.proc == nil {
+		return
+	}
+	log.Printf("[LFD][%s] stopping server %s (pid %d)", m.lfdID, m.serverID, m.proc.Process.Pid)
+	_ = m.proc.Process.Signal(os.Interrupt)
+	select {
+	case <-m.exited:
+	case <-time.After(m.timeout):
+		_ = m.proc.Process.Kill()
+		<-m.exited
+	}
+	m.proc = nil
+	if m.serverAlive {
+		m.serverAlive = false
+		m.notifyGFD(m.serverID, protocol.Delete{ServerID: m.serverID})
+	}
+}
@@ -0,0 +1,271 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/wenyinh/18749-project/utils"
+)
+
+// Message types shared by client, server, LFD and GFD
+const (
+	TypePing       = "PING"
+	TypePong       = "PONG"
+	TypeRegister   = "REGISTER"
+	TypeHello      = "HELLO"
+	TypeAck        = "ACK"
+	TypeNack       = "NACK"
+	TypeReq        = "REQ"
+	TypeResp       = "RESP"
+	TypeCheckpoint = "CHECKPOINT"
+	TypeGFDPing    = "GFD_PING"
+	TypeGFDPong    = "GFD_PONG"
+	TypeAdd        = "ADD"
+	TypeDelete     = "DELETE"
+)
+
+// Version is the protocol version this build speaks and MinVersion the
+// oldest one it still accepts. Version 1 is the envelope without handshake
+// versions, so a peer that sends no version speaks version 1.
+const (
+	Version    = 2
+	MinVersion = 1
+)
+
+// Optional features a peer can announce in a handshake
+const (
+	CapFraming      = "framing"       // Length-prefixed frames, see utils.Negotiate
+	CapHeartbeatSeq = "heartbeat_seq" // PONG and GFD_PONG echo the ping's sequence number
+	CapExactlyOnce  = "exactly_once"  // A repeated request number is answered from the reply cache
+	CapMultiServer  = "multi_server"  // GFD accepts an LFD registering several servers
+)
+
+// Capabilities lists the features this build supports
+var Capabilities = []string{CapFraming, CapHeartbeatSeq, CapExactlyOnce, CapMultiServer}
+
+// Envelope is the wire form of every message in this package, one JSON
+// object per line (or frame):
+//
+//	{"type":"REQ","sender":"C1","seq":3,"payload":{"message":"hello"}}
+//
+// Seq numbers messages per sender where that means something: the request
+// number for REQ/RESP, the checkpoint number for CHECKPOINT and the
+// heartbeat count for PING/PONG and GFD_PING/GFD_PONG.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Sender  string          `json:"sender"`
+	Seq     int             `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Message is a typed payload carried in an Envelope
+type Message interface {
+	MessageType() string
+}
+
+// Ping is a heartbeat from LFD to its server
+type Ping struct{}
+
+// Pong answers a Ping with the same sequence number
+type Pong struct{}
+
+// Handshake is the version and feature set offered in REGISTER and HELLO,
+// and the agreed ones returned in the ACK
+type Handshake struct {
+	Version      int      `json:"version,omitempty"`
+	MinVersion   int      `json:"min_version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Register opens an LFD's session with its server and with GFD. An LFD
+// monitoring several servers lists them all in ServerIDs when registering
+// with GFD; ServerID is the first of them.
+type Register struct {
+	ServerID  string   `json:"server_id"`
+	ServerIDs []string `json:"server_ids,omitempty"`
+	Handshake
+}
+
+// Servers returns the servers a registration covers
+func (r Register) Servers() []string {
+	if len(r.ServerIDs) > 0 {
+		return r.ServerIDs
+	}
+	if r.ServerID == "" {
+		return nil
+	}
+	return []string{r.ServerID}
+}
+
+// Hello opens a client's session with a server
+type Hello struct {
+	Handshake
+}
+
+// Ack accepts a registration or command; for REGISTER and HELLO it carries
+// the agreed version and capabilities
+type Ack struct {
+	Handshake
+}
+
+// Nack rejects a registration or command
+type Nack struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// Request is a client request; the sender is the client and Seq the request number
+type Request struct {
+	Message string `json:"message"`
+}
+
+// Response answers a Request; the sender is the replica and Seq the request number
+type Response struct {
+	ClientID string `json:"client_id"`
+	Message  string `json:"message"`
+}
+
+// Reply is a Response with its sender and request number, as a client
+// receives it and as the reply cache keeps it
+type Reply struct {
+	ServerID   string `json:"server_id"`
+	RequestNum int    `json:"request_num"`
+	Message    string `json:"message"`
+}
+
+// Checkpoint carries a replica's state; the sender is the primary and Seq the
+// checkpoint number
+type Checkpoint struct {
+	State   []byte `json:"state"`
+	LastSeq int    `json:"last_seq"` // Last ordered request reflected in State
+	// Replies is the per-client reply cache, keyed by client ID
+	Replies map[string]Reply `json:"replies,omitempty"`
+	// Delta marks State as the changes since checkpoint BaseNum
+	Delta   bool `json:"delta,omitempty"`
+	BaseNum int  `json:"base_num,omitempty"`
+}
+
+// GFDPing is a heartbeat from GFD to an LFD
+type GFDPing struct{}
+
+// GFDPong answers a GFDPing
+type GFDPong struct{}
+
+// Add reports a server as alive to GFD
+type Add struct {
+	ServerID string `json:"server_id"`
+}
+
+// Delete reports a server as failed to GFD
+type Delete struct {
+	ServerID string `json:"server_id"`
+}
+
+func (Ping) MessageType() string       { return TypePing }
+func (Pong) MessageType() string       { return TypePong }
+func (Register) MessageType() string   { return TypeRegister }
+func (Hello) MessageType() string      { return TypeHello }
+func (Ack) MessageType() string        { return TypeAck }
+func (Nack) MessageType() string       { return TypeNack }
+func (Request) MessageType() string    { return TypeReq }
+func (Response) MessageType() string   { return TypeResp }
+func (Checkpoint) MessageType() string { return TypeCheckpoint }
+func (GFDPing) MessageType() string    { return TypeGFDPing }
+func (GFDPong) MessageType() string    { return TypeGFDPong }
+func (Add) MessageType() string        { return TypeAdd }
+func (Delete) MessageType() string     { return TypeDelete }
+
+// Offer returns the handshake this build sends
+func Offer() Handshake {
+	return Handshake{Version: Version, MinVersion: MinVersion, Capabilities: Capabilities}
+}
+
+// Agree returns the version and capabilities shared with a peer that offered
+// h, or an error naming the mismatch
+func (h Handshake) Agree() (Handshake, error) {
+	version := h.Version
+	if version == 0 {
+		version = 1
+	}
+	if version < MinVersion {
+		return Handshake{}, fmt.Errorf("protocol version %d is no longer supported (this side speaks %d..%d)", version, MinVersion, Version)
+	}
+	if h.MinVersion > Version {
+		return Handshake{}, fmt.Errorf("peer needs protocol version %d or later (this side speaks %d..%d)", h.MinVersion, MinVersion, Version)
+	}
+	if version > Version {
+		version = Version
+	}
+	var common []string
+	for _, c := range h.Capabilities {
+		for _, own := range Capabilities {
+			if c == own {
+				common = append(common, c)
+				break
+			}
+		}
+	}
+	return Handshake{Version: version, Capabilities: common}, nil
+}
+
+// Has reports whether capability c was agreed
+func (h Handshake) Has(c string) bool {
+	for _, have := range h.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode wraps msg in an envelope and returns its wire form
+func Encode(sender string, seq int, msg Message) (string, error) {
+	env := Envelope{Type: msg.MessageType(), Sender: sender, Seq: seq}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	if string(payload) != "{}" {
+		env.Payload = payload
+	}
+	line, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
+// Decode parses the wire form of an envelope
+func Decode(line string) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal([]byte(line), &env); err != nil {
+		return env, fmt.Errorf("not a protocol message: %q", line)
+	}
+	if env.Type == "" {
+		return env, fmt.Errorf("message without type: %q", line)
+	}
+	return env, nil
+}
+
+// Unmarshal decodes the payload into msg, which must be of the envelope's type
+func (e Envelope) Unmarshal(msg Message) error {
+	if msg.MessageType() != e.Type {
+		return fmt.Errorf("expected %s, got %s", msg.MessageType(), e.Type)
+	}
+	if len(e.Payload) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(e.Payload, msg); err != nil {
+		return fmt.Errorf("bad %s payload: %w", e.Type, err)
+	}
+	return nil
+}
+
+// Send writes msg to conn as one envelope
+func Send(conn net.Conn, sender string, seq int, msg Message) error {
+	line, err := Encode(sender, seq, msg)
+	if err != nil {
+		return err
+	}
+	return utils.WriteLine(conn, line)
+}
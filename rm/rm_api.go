@@ -0,0 +1,5 @@
+package rm
+
+type RM interface {
+	Run() error
+}
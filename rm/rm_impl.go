@@ -0,0 +1,344 @@
+package rm
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wenyinh/18749-project/protocol"
+	"github.com/wenyinh/18749-project/utils"
+)
+
+const (
+	subscribe  = "SUBSCRIBE"
+	membership = "MEMBERSHIP"
+	primary    = "PRIMARY"
+	promote    = "PROMOTE"
+	demote     = "DEMOTE"
+
+	// sendRoleAttempts bounds how often RM retries a PROMOTE/DEMOTE that was not acknowledged
+	sendRoleAttempts = 5
+)
+
+type rm struct {
+	rmID       string
+	addr       string // Listen address for client subscriptions
+	gfdAddr    string
+	servers    map[string]string // Map of server ID -> server address
+	membership []string          // Latest membership reported by GFD
+	primaryID  string            // Currently elected primary ("" if none)
+	clients    map[net.Conn]string
+	timeout    time.Duration
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	mu         sync.Mutex
+}
+
+func NewRM(rmID, addr, gfdAddr string, servers map[string]string, timeout, baseDelay, maxDelay time.Duration) RM {
+	if servers == nil {
+		servers = make(map[string]string)
+	}
+	return &rm{
+		rmID:       rmID,
+		addr:       addr,
+		gfdAddr:    gfdAddr,
+		servers:    servers,
+		membership: make([]string, 0),
+		clients:    make(map[net.Conn]string),
+		timeout:    timeout,
+		baseDelay:  baseDelay,
+		maxDelay:   maxDelay,
+	}
+}
+
+func (m *rm) Run() error {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	listener := utils.MustListen(m.addr)
+	log.Printf("[RM][%s] listening on %s, GFD at %s", m.rmID, m.addr, m.gfdAddr)
+
+	m.printStatus()
+
+	// Follow GFD membership in the background
+	go m.watchGFD()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("[RM][%s] accept error: %v", m.rmID, err)
+			continue
+		}
+		go m.handleClient(conn)
+	}
+}
+
+// watchGFD keeps a membership subscription open to GFD, reconnecting with backoff
+func (m *rm) watchGFD() {
+	attempt := 0
+	for {
+		err := m.followGFD()
+		if err == nil {
+			attempt = 0
+		}
+		delay := m.calculateBackoffDelay(attempt)
+		log.Printf("[RM][%s] GFD subscription lost (%v), reconnecting in %v...", m.rmID, err, delay)
+		time.Sleep(delay)
+		attempt++
+	}
+}
+
+// followGFD subscribes to GFD and processes membership updates until the connection drops.
+// A nil error means the subscription was established before it was lost.
+func (m *rm) followGFD() error {
+	conn, err := utils.Dial(m.gfdAddr, m.timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := utils.WriteLine(conn, fmt.Sprintf("%s %s", subscribe, m.rmID)); err != nil {
+		return err
+	}
+	log.Printf("[RM][%s] subscribed to GFD membership at %s", m.rmID, m.gfdAddr)
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := utils.ReadLine(r)
+		if err != nil {
+			log.Printf("[RM][%s] GFD connection closed: %v", m.rmID, err)
+			return nil
+		}
+		parts := strings.Fields(line)
+		if len(parts) == 0 || parts[0] != membership {
+			log.Printf("[RM][%s] unexpected message from GFD: %s", m.rmID, line)
+			continue
+		}
+		m.updateMembership(parts[1:])
+	}
+}
+
+// updateMembership records the new membership, elects a new primary if the
+// current one is gone, and pushes role changes to servers and clients
+func (m *rm) updateMembership(members []string) {
+	m.mu.Lock()
+	prev := make(map[string]bool, len(m.membership))
+	for _, id := range m.membership {
+		prev[id] = true
+	}
+	m.membership = members
+
+	oldPrimary := m.primaryID
+	if !contains(members, m.primaryID) {
+		m.primaryID = m.electLocked(members)
+	}
+	newPrimary := m.primaryID
+
+	// Newly joined replicas that are not the primary must run as backups
+	var demotions []string
+	for _, id := range members {
+		if !prev[id] && id != newPrimary {
+			demotions = append(demotions, id)
+		}
+	}
+	m.printStatusLocked()
+	m.mu.Unlock()
+
+	if newPrimary != oldPrimary {
+		if oldPrimary == "" {
+			log.Printf("[RM][%s] elected %s as primary", m.rmID, newPrimary)
+		} else if newPrimary == "" {
+			log.Printf("[RM][%s] primary %s failed and no replica is left to elect", m.rmID, oldPrimary)
+		} else {
+			log.Printf("[RM][%s] primary %s failed, elected %s as new primary", m.rmID, oldPrimary, newPrimary)
+		}
+		if newPrimary != "" {
+			go m.sendRole(newPrimary, promote)
+		}
+		m.broadcastPrimary(newPrimary)
+	}
+	for _, id := range demotions {
+		go m.sendRole(id, demote)
+	}
+}
+
+// electLocked picks the lowest server ID among live members that RM can reach
+// Caller must hold m.mu
+func (m *rm) electLocked(members []string) string {
+	candidates := make([]string, 0, len(members))
+	for _, id := range members {
+		if _, ok := m.servers[id]; ok {
+			candidates = append(candidates, id)
+		} else {
+			log.Printf("[RM][%s] member %s has no known address, not eligible as primary", m.rmID, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Strings(candidates)
+	return candidates[0]
+}
+
+// sendRole tells a server to switch role (PROMOTE or DEMOTE), retrying with backoff
+// until it acknowledges or the decision is superseded by a later election
+func (m *rm) sendRole(serverID, cmd string) {
+	for attempt := 0; attempt < sendRoleAttempts; attempt++ {
+		m.mu.Lock()
+		addr, ok := m.servers[serverID]
+		isPrimary := m.primaryID == serverID
+		m.mu.Unlock()
+		if !ok {
+			log.Printf("[RM][%s] no address for server %s, cannot send %s", m.rmID, serverID, cmd)
+			return
+		}
+		if (cmd == promote) != isPrimary {
+			log.Printf("[RM][%s] %s for %s superseded by a later election", m.rmID, cmd, serverID)
+			return
+		}
+		if attempt > 0 {
+			time.Sleep(m.calculateBackoffDelay(attempt - 1))
+		}
+		if err := m.trySendRole(serverID, addr, cmd); err != nil {
+			log.Printf("[RM][%s] %s to %s@%s failed (attempt %d/%d): %v",
+				m.rmID, cmd, serverID, addr, attempt+1, sendRoleAttempts, err)
+			continue
+		}
+		log.Printf("[RM][%s] %s acknowledged %s", m.rmID, serverID, cmd)
+		return
+	}
+}
+
+func (m *rm) trySendRole(serverID, addr, cmd string) error {
+	conn, err := utils.Dial(addr, m.timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(m.timeout))
+	if err := utils.WriteLine(conn, cmd); err != nil {
+		return err
+	}
+	reply, err := utils.ReadLine(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	if env, err := protocol.Decode(reply); err != nil || env.Type != protocol.TypeAck {
+		return fmt.Errorf("%s rejected %s: %s", serverID, cmd, reply)
+	}
+	return nil
+}
+
+// handleClient serves a client subscription: "SUBSCRIBE <clientID>" is answered
+// with the current primary and every later change as "PRIMARY <serverID>"
+func (m *rm) handleClient(conn net.Conn) {
+	defer func() {
+		m.mu.Lock()
+		if clientID, ok := m.clients[conn]; ok {
+			delete(m.clients, conn)
+			log.Printf("[RM][%s] client %s unsubscribed", m.rmID, clientID)
+		}
+		m.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	c, err := utils.Accept(conn)
+	if err != nil {
+		return
+	}
+	// Subscriptions are keyed by the negotiated connection
+	conn = c
+	r := bufio.NewReader(c)
+	for {
+		line, err := utils.ReadLine(r)
+		if err != nil {
+			return
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 || parts[0] != subscribe {
+			log.Printf("[RM][%s] unknown command from %s: %s", m.rmID, conn.RemoteAddr(), line)
+			continue
+		}
+
+		m.mu.Lock()
+		m.clients[conn] = parts[1]
+		m.sendPrimaryLocked(conn, parts[1], m.primaryID)
+		m.mu.Unlock()
+		log.Printf("[RM][%s] client %s subscribed to primary updates", m.rmID, parts[1])
+	}
+}
+
+func (m *rm) broadcastPrimary(primaryID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for conn, clientID := range m.clients {
+		m.sendPrimaryLocked(conn, clientID, primaryID)
+	}
+}
+
+// sendPrimaryLocked announces the primary to one client; "" is announced as no primary
+// Caller must hold m.mu
+func (m *rm) sendPrimaryLocked(conn net.Conn, clientID, primaryID string) {
+	msg := strings.TrimSpace(primary + " " + primaryID)
+	_ = conn.SetWriteDeadline(time.Now().Add(m.timeout))
+	if err := utils.WriteLine(conn, msg); err != nil {
+		log.Printf("[RM][%s] failed to notify client %s: %v (dropping)", m.rmID, clientID, err)
+		delete(m.clients, conn)
+		_ = conn.Close()
+	}
+}
+
+func (m *rm) calculateBackoffDelay(attempt int) time.Duration {
+	if attempt > 16 {
+		attempt = 16
+	}
+	delay := time.Duration(1<<uint(attempt)) * m.baseDelay
+	if delay > m.maxDelay {
+		delay = m.maxDelay
+	}
+	return delay
+}
+
+func (m *rm) printStatus() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.printStatusLocked()
+}
+
+func (m *rm) printStatusLocked() {
+	green := "\033[32m"
+	reset := "\033[0m"
+	primaryID := m.primaryID
+	if primaryID == "" {
+		primaryID = "none"
+	}
+	switch len(m.membership) {
+	case 0:
+		fmt.Printf("%sRM: 0 members (primary: %s)%s\n", green, primaryID, reset)
+	case 1:
+		fmt.Printf("%sRM: 1 member: %s (primary: %s)%s\n", green, m.membership[0], primaryID, reset)
+	default:
+		fmt.Printf("%sRM: %d members: %s (primary: %s)%s\n",
+			green, len(m.membership), strings.Join(m.membership, ", "), primaryID, reset)
+	}
+}
+
+func contains(list []string, id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, v := range list {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
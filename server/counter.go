@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// counter is the default application: every request increments an integer
+// and the reply is the new value
+type counter struct {
+	value int
+}
+
+func NewCounter(initial int) StateMachine {
+	return &counter{value: initial}
+}
+
+func (c *counter) Apply(command string) string {
+	c.value++
+	return strconv.Itoa(c.value)
+}
+
+func (c *counter) Snapshot() ([]byte, error) {
+	return json.Marshal(c.value)
+}
+
+func (c *counter) Restore(snapshot []byte) error {
+	var value int
+	if err := json.Unmarshal(snapshot, &value); err != nil {
+		return err
+	}
+	c.value = value
+	return nil
+}
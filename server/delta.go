@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/wenyinh/18749-project/utils"
+)
+
+// nextCheckpointLocked builds checkpoint #CheckpointNo+1. Applications that
+// implement DeltaStateMachine get a delta against the previous checkpoint,
+// except for the first checkpoint as primary, every FullEvery checkpoints and
+// after a backup asked for a full one.
+// Caller must hold s.mu
+func (s *server) nextCheckpointLocked() (CheckpointMessage, error) {
+	num := s.CheckpointNo + 1
+	dsm, ok := s.App.(DeltaStateMachine)
+	if !ok {
+		return s.snapshotLocked(num)
+	}
+
+	if s.needFull || s.FullEvery <= 1 || num-s.lastFullNo >= s.FullEvery {
+		ckpt, err := s.snapshotLocked(num)
+		if err != nil {
+			return ckpt, err
+		}
+		// Restart change tracking at this snapshot
+		if _, err := dsm.Delta(); err != nil {
+			return ckpt, err
+		}
+		s.needFull = false
+		s.lastFullNo = num
+		return ckpt, nil
+	}
+
+	delta, err := dsm.Delta()
+	if err != nil {
+		// The tracked changes may be lost, only a snapshot is safe now
+		s.needFull = true
+		return CheckpointMessage{}, err
+	}
+	return CheckpointMessage{
+		Type:          Checkpoint,
+		ReplicaId:     s.ReplicaId,
+		State:         delta,
+		CheckpointNum: num,
+		LastSeq:       s.nextSeq - 1,
+		Replies:       s.copyRepliesLocked(),
+		Delta:         true,
+		BaseNum:       s.CheckpointNo,
+	}, nil
+}
+
+// restoreLocked installs the state carried by a checkpoint, full or delta
+// Caller must hold s.mu
+func (s *server) restoreLocked(ckpt CheckpointMessage) error {
+	if !ckpt.Delta {
+		return s.App.Restore(ckpt.State)
+	}
+	dsm, ok := s.App.(DeltaStateMachine)
+	if !ok {
+		return fmt.Errorf("application does not support delta checkpoints")
+	}
+	if ckpt.BaseNum != s.CheckpointNo {
+		return fmt.Errorf("delta base #%d does not match local checkpoint #%d", ckpt.BaseNum, s.CheckpointNo)
+	}
+	return dsm.ApplyDelta(ckpt.State)
+}
+
+// durableCheckpointLocked returns the full form of a checkpoint to write to
+// disk, which only ever holds full snapshots. The bool is false if there is
+// nothing to persist.
+// Caller must hold s.mu, with ckpt already applied
+func (s *server) durableCheckpointLocked(ckpt CheckpointMessage) (CheckpointMessage, bool) {
+	if !ckpt.Delta {
+		return ckpt, true
+	}
+	if s.store == nil {
+		return ckpt, false
+	}
+	full, err := s.snapshotLocked(ckpt.CheckpointNum)
+	if err != nil {
+		log.Printf("[SERVER][%s] snapshot failed, checkpoint #%d not persisted: %v", s.ReplicaId, ckpt.CheckpointNum, err)
+		return ckpt, false
+	}
+	return full, true
+}
+
+// requestFullCheckpoint asks the primary, over the secondary channel the
+// rejected delta came in on, to make its next checkpoint a full snapshot
+func (s *server) requestFullCheckpoint(conn net.Conn, ckpt CheckpointMessage) {
+	s.mu.Lock()
+	msg := CheckpointAckMessage{
+		Type:          FullCheckpointReq,
+		ReplicaId:     s.ReplicaId,
+		CheckpointNum: s.CheckpointNo,
+		LastSeq:       s.nextSeq - 1,
+	}
+	s.mu.Unlock()
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("[SERVER][%s] marshal full checkpoint request failed: %v", s.ReplicaId, err)
+		return
+	}
+	if err := utils.WriteLine(conn, string(payload)); err != nil {
+		log.Printf("[SERVER][%s] request full checkpoint from %s failed: %v", s.ReplicaId, ckpt.ReplicaId, err)
+		return
+	}
+	log.Printf("[SERVER][%s] requested a full checkpoint from %s", s.ReplicaId, ckpt.ReplicaId)
+}
+
+// describeCheckpoint names a checkpoint's kind for logs
+func describeCheckpoint(ckpt CheckpointMessage) string {
+	if ckpt.Delta {
+		return fmt.Sprintf("delta on #%d", ckpt.BaseNum)
+	}
+	return "full"
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+const (
+	kvPut    = "PUT"
+	kvGet    = "GET"
+	kvDelete = "DELETE"
+	kvCas    = "CAS"
+
+	kvOK       = "OK"
+	kvNotFound = "NOT_FOUND"
+	kvMismatch = "MISMATCH"
+)
+
+// kvStore is a replicated key-value application. Commands:
+//
+//	PUT k v         -> OK
+//	GET k           -> v | NOT_FOUND
+//	DELETE k        -> OK | NOT_FOUND
+//	CAS k old new   -> OK | MISMATCH <current> | NOT_FOUND
+//
+// Keys and CAS values are single words; a PUT value is the rest of the line.
+type kvStore struct {
+	data map[string]string
+	// dirty holds the keys changed since the last Delta. It is nil until the
+	// first Delta call, so replicas that never take delta checkpoints (active
+	// mode, backups) do not track anything.
+	dirty map[string]bool
+}
+
+// kvDelta holds the final value of every changed key; deleted keys are in Del
+type kvDelta struct {
+	Set map[string]string `json:"set,omitempty"`
+	Del []string          `json:"del,omitempty"`
+}
+
+func NewKVStore() StateMachine {
+	return &kvStore{data: make(map[string]string)}
+}
+
+func (kv *kvStore) Apply(command string) string {
+	parts := strings.Fields(command)
+	if len(parts) == 0 {
+		return "ERROR: empty command"
+	}
+	switch strings.ToUpper(parts[0]) {
+	case kvPut:
+		if len(parts) < 3 {
+			return "ERROR: usage PUT <key> <value>"
+		}
+		kv.data[parts[1]] = putValue(command)
+		kv.markDirty(parts[1])
+		return kvOK
+	case kvGet:
+		if len(parts) != 2 {
+			return "ERROR: usage GET <key>"
+		}
+		v, ok := kv.data[parts[1]]
+		if !ok {
+			return kvNotFound
+		}
+		return v
+	case kvDelete:
+		if len(parts) != 2 {
+			return "ERROR: usage DELETE <key>"
+		}
+		if _, ok := kv.data[parts[1]]; !ok {
+			return kvNotFound
+		}
+		delete(kv.data, parts[1])
+		kv.markDirty(parts[1])
+		return kvOK
+	case kvCas:
+		if len(parts) != 4 {
+			return "ERROR: usage CAS <key> <old> <new>"
+		}
+		cur, ok := kv.data[parts[1]]
+		if !ok {
+			return kvNotFound
+		}
+		if cur != parts[2] {
+			return kvMismatch + " " + cur
+		}
+		kv.data[parts[1]] = parts[3]
+		kv.markDirty(parts[1])
+		return kvOK
+	default:
+		return "ERROR: unknown command " + parts[0]
+	}
+}
+
+func (kv *kvStore) markDirty(key string) {
+	if kv.dirty != nil {
+		kv.dirty[key] = true
+	}
+}
+
+// putValue returns everything after "PUT <key> ", keeping inner spacing.
+// Words are split on the same whitespace as strings.Fields in Apply.
+func putValue(command string) string {
+	rest := strings.TrimSpace(command)
+	for i := 0; i < 2; i++ {
+		idx := strings.IndexFunc(rest, unicode.IsSpace)
+		if idx < 0 {
+			return ""
+		}
+		rest = strings.TrimLeftFunc(rest[idx:], unicode.IsSpace)
+	}
+	return rest
+}
+
+func (kv *kvStore) Snapshot() ([]byte, error) {
+	return json.Marshal(kv.data)
+}
+
+func (kv *kvStore) Restore(snapshot []byte) error {
+	data := make(map[string]string)
+	if err := json.Unmarshal(snapshot, &data); err != nil {
+		return err
+	}
+	if data == nil {
+		data = make(map[string]string)
+	}
+	kv.data = data
+	// The next full checkpoint restarts change tracking
+	kv.dirty = nil
+	return nil
+}
+
+func (kv *kvStore) Delta() ([]byte, error) {
+	d := kvDelta{Set: make(map[string]string)}
+	for k := range kv.dirty {
+		if v, ok := kv.data[k]; ok {
+			d.Set[k] = v
+		} else {
+			d.Del = append(d.Del, k)
+		}
+	}
+	kv.dirty = make(map[string]bool)
+	return json.Marshal(d)
+}
+
+func (kv *kvStore) ApplyDelta(delta []byte) error {
+	var d kvDelta
+	if err := json.Unmarshal(delta, &d); err != nil {
+		return err
+	}
+	for k, v := range d.Set {
+		kv.data[k] = v
+	}
+	for _, k := range d.Del {
+		delete(kv.data, k)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import "testing"
+
+func TestKVStorePutValue(t *testing.T) {
+	tests := []struct {
+		command string
+		key     string
+		want    string
+	}{
+		{"PUT a 1", "a", "1"},
+		{"PUT a hello  world ", "a", "hello  world"},
+		{"put\ta\tx y", "a", "x y"},
+		// Separators strings.Fields accepts must not crash putValue
+		{"PUT k\u00a0v", "k", "v"},
+		{"PUT k\rv", "k", "v"},
+		{"PUT\u2003k\u2003v\u00a0w", "k", "v\u00a0w"},
+	}
+	for _, tt := range tests {
+		kv := NewKVStore()
+		if got := kv.Apply(tt.command); got != kvOK {
+			t.Fatalf("Apply(%q) = %q, want %q", tt.command, got, kvOK)
+		}
+		if got := kv.Apply("GET " + tt.key); got != tt.want {
+			t.Errorf("after %q: GET %s = %q, want %q", tt.command, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestKVStoreUsage(t *testing.T) {
+	kv := NewKVStore()
+	for _, command := range []string{"", "PUT", "PUT k", "PUT k ", "GET", "CAS k 1"} {
+		if got := kv.Apply(command); len(got) < 6 || got[:6] != "ERROR:" {
+			t.Errorf("Apply(%q) = %q, want an error", command, got)
+		}
+	}
+}
+
+func TestKVStoreDeltaTracking(t *testing.T) {
+	kv := NewKVStore().(*kvStore)
+	kv.Apply("PUT a 1")
+	if kv.dirty != nil {
+		t.Fatalf("changes tracked before the first Delta: %v", kv.dirty)
+	}
+
+	// A full checkpoint calls Delta to start tracking
+	if _, err := kv.Delta(); err != nil {
+		t.Fatal(err)
+	}
+	kv.Apply("PUT b 2")
+	kv.Apply("DELETE a")
+	delta, err := kv.Delta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replica := NewKVStore().(*kvStore)
+	replica.Apply("PUT a 1")
+	if err := replica.ApplyDelta(delta); err != nil {
+		t.Fatal(err)
+	}
+	if got := replica.Apply("GET b"); got != "2" {
+		t.Errorf("GET b = %q after delta, want 2", got)
+	}
+	if got := replica.Apply("GET a"); got != kvNotFound {
+		t.Errorf("GET a = %q after delta, want %s", got, kvNotFound)
+	}
+
+	if err := kv.Restore([]byte(`{"c":"3"}`)); err != nil {
+		t.Fatal(err)
+	}
+	kv.Apply("PUT d 4")
+	if kv.dirty != nil {
+		t.Errorf("changes tracked after Restore: %v", kv.dirty)
+	}
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/wenyinh/18749-project/utils"
+)
+
+const (
+	// orderWaitTimeout bounds how long a replica holds a client request waiting for its ORDER
+	orderWaitTimeout = 5 * time.Second
+	// peerRedialFreq is how often an active-mode sequencer retries missing peer channels
+	peerRedialFreq = time.Second
+)
+
+func requestKey(clientID string, requestNum int) string {
+	return fmt.Sprintf("%s#%d", clientID, requestNum)
+}
+
+// orderRequest runs a client request through the total order and waits until
+// this replica has applied it. The bool is false if no reply should be sent.
+func (s *server) orderRequest(req RequestMessage) (ResponseMessage, bool) {
+	key := requestKey(req.ClientID, req.RequestNum)
+
+	s.mu.Lock()
+	if last, ok := s.replies[req.ClientID]; ok && last.RequestNum >= req.RequestNum {
+		s.mu.Unlock()
+		if last.RequestNum == req.RequestNum {
+			log.Printf("[SERVER][%s] duplicate request %s, replying from reply cache", s.ReplicaId, key)
+			last.ServerID = s.ReplicaId
+			return last, true
+		}
+		log.Printf("[SERVER][%s] request %s is older than last applied request_num=%d, dropping",
+			s.ReplicaId, key, last.RequestNum)
+		return ResponseMessage{}, false
+	}
+	ch := make(chan ResponseMessage, 1)
+	s.waiters[key] = ch
+	s.pending[key] = req
+	sequencer := s.ServerRole == Primary
+	s.mu.Unlock()
+
+	if sequencer {
+		s.sequence(req)
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, true
+	case <-time.After(orderWaitTimeout):
+		s.mu.Lock()
+		if s.waiters[key] == ch {
+			delete(s.waiters, key)
+		}
+		s.mu.Unlock()
+		log.Printf("[SERVER][%s] request %s not ordered within %v, no reply sent", s.ReplicaId, key, orderWaitTimeout)
+		return ResponseMessage{}, false
+	}
+}
+
+// sequence assigns the next sequence number to a pending request, sends the
+// ORDER to every peer and applies it locally. Only the primary sequences; in
+// passive mode this forwards the request to the backups' request logs.
+func (s *server) sequence(req RequestMessage) {
+	key := requestKey(req.ClientID, req.RequestNum)
+
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+
+	s.mu.Lock()
+	if s.ServerRole != Primary {
+		s.mu.Unlock()
+		return
+	}
+	if _, ok := s.pending[key]; !ok {
+		// Already ordered (e.g. by a previous sequencer)
+		s.mu.Unlock()
+		return
+	}
+	ord := OrderMessage{
+		Type:      Order,
+		ReplicaId: s.ReplicaId,
+		Seq:       s.nextSeq,
+		Request:   req,
+	}
+	conns := make(map[string]net.Conn, len(s.BackupConns))
+	for id, c := range s.BackupConns {
+		conns[id] = c
+	}
+	s.mu.Unlock()
+
+	payload, err := json.Marshal(ord)
+	if err != nil {
+		log.Printf("[SERVER][%s] marshal order failed: %v", s.ReplicaId, err)
+		return
+	}
+	s.broadcast(conns, string(payload), fmt.Sprintf("order #%d (%s)", ord.Seq, key))
+
+	s.mu.Lock()
+	s.deliverLocked(ord)
+	s.mu.Unlock()
+}
+
+// broadcast writes one line to every peer channel, dropping channels that fail
+func (s *server) broadcast(conns map[string]net.Conn, line, what string) {
+	for bid, c := range conns {
+		if c == nil {
+			continue
+		}
+		_ = c.SetWriteDeadline(time.Now().Add(orderWaitTimeout))
+		err := utils.WriteLine(c, line)
+		// Checkpoints share the channel and must not inherit this deadline
+		_ = c.SetWriteDeadline(time.Time{})
+		if err != nil {
+			log.Printf("[SERVER][%s] send %s to %s failed: %v (will drop conn)", s.ReplicaId, what, bid, err)
+			s.mu.Lock()
+			if old, ok := s.BackupConns[bid]; ok && old == c {
+				_ = old.Close()
+				delete(s.BackupConns, bid)
+			}
+			s.mu.Unlock()
+			continue
+		}
+		log.Printf("[SERVER][%s] %s sent to %s", s.ReplicaId, what, bid)
+	}
+}
+
+// deliverLocked buffers an ordered request and applies what became contiguous,
+// answering any waiting client handler
+// Caller must hold s.mu
+func (s *server) deliverLocked(ord OrderMessage) {
+	if ord.Seq < s.nextSeq {
+		log.Printf("[SERVER][%s] ignore duplicate order #%d (next=%d)", s.ReplicaId, ord.Seq, s.nextSeq)
+		return
+	}
+	s.orderBuf[ord.Seq] = ord.Request
+	s.applyOrderedLocked()
+	if len(s.orderBuf) > 0 && s.ready && s.ServerMode == Active && s.ServerRole != Primary && !s.catchingUp {
+		// The orders before this one were lost with a dropped channel; the
+		// sequencer's redial carries no state, so fetch it
+		s.catchingUp = true
+		go s.catchUp(ord.ReplicaId)
+	}
+}
+
+// catchUp installs a checkpoint from the sequencer after an order gap. The
+// sequencer reopens our channel while capturing the state, like for a joiner,
+// so every order after the checkpoint reaches us.
+func (s *server) catchUp(sequencer string) {
+	defer func() {
+		s.mu.Lock()
+		s.catchingUp = false
+		s.mu.Unlock()
+	}()
+	s.mu.Lock()
+	addr, ok := s.Backups[sequencer]
+	s.mu.Unlock()
+	if !ok {
+		log.Printf("[SERVER][%s] order gap, but sequencer %s is not a known peer", s.ReplicaId, sequencer)
+		return
+	}
+	log.Printf("[SERVER][%s] missing orders, fetching state from sequencer %s", s.ReplicaId, sequencer)
+	ckpt, err := s.requestState(sequencer, addr)
+	if err != nil {
+		log.Printf("[SERVER][%s] catch-up from %s@%s failed: %v", s.ReplicaId, sequencer, addr, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ckpt.LastSeq < s.nextSeq {
+		log.Printf("[SERVER][%s] already past checkpoint from %s (last_seq=%d, next=%d)",
+			s.ReplicaId, sequencer, ckpt.LastSeq, s.nextSeq)
+		return
+	}
+	if err := s.installCheckpointLocked(ckpt); err != nil {
+		log.Printf("[SERVER][%s] install catch-up checkpoint from %s failed: %v", s.ReplicaId, sequencer, err)
+		return
+	}
+	s.settleCoveredLocked()
+	log.Printf("[SERVER][%s] caught up with %s: last_seq=%d, %d orders still held",
+		s.ReplicaId, sequencer, ckpt.LastSeq, len(s.orderBuf))
+}
+
+// settleCoveredLocked answers the waiting clients whose requests an installed
+// checkpoint already covers; their ORDERs will not arrive anymore
+// Caller must hold s.mu
+func (s *server) settleCoveredLocked() {
+	for key, req := range s.pending {
+		last, ok := s.replies[req.ClientID]
+		if !ok || last.RequestNum < req.RequestNum {
+			continue
+		}
+		delete(s.pending, key)
+		if ch, ok := s.waiters[key]; ok {
+			if last.RequestNum == req.RequestNum {
+				last.ServerID = s.ReplicaId
+				ch <- last
+			}
+			delete(s.waiters, key)
+		}
+	}
+}
+
+// applyOrderedLocked applies every buffered request that is contiguous with the
+// applied prefix. Nothing is applied until the replica has recovered its state,
+// and passive backups only keep the log for replay on promotion.
+// Caller must hold s.mu
+func (s *server) applyOrderedLocked() {
+	if !s.ready {
+		log.Printf("[SERVER][%s] recovering, logged %d orders for replay", s.ReplicaId, len(s.orderBuf))
+		return
+	}
+	if s.ServerMode == Passive && s.ServerRole != Primary {
+		log.Printf("[SERVER][%s] request log holds %d requests since checkpoint #%d",
+			s.ReplicaId, len(s.orderBuf), s.CheckpointNo)
+		return
+	}
+	for {
+		req, ok := s.orderBuf[s.nextSeq]
+		if !ok {
+			break
+		}
+		key := requestKey(req.ClientID, req.RequestNum)
+		if err := s.appendWALLocked(s.nextSeq, req); err != nil {
+			// Applying what we cannot replay would lose it on a restart
+			s.stopServingLocked(err)
+			delete(s.pending, key)
+			if ch, ok := s.waiters[key]; ok {
+				ch <- ResponseMessage{
+					Type:       Resp,
+					ServerID:   s.ReplicaId,
+					ClientID:   req.ClientID,
+					RequestNum: req.RequestNum,
+					Message:    "ERROR: request could not be logged",
+				}
+				delete(s.waiters, key)
+			}
+			return
+		}
+		delete(s.orderBuf, s.nextSeq)
+		log.Printf("[SERVER][%s] applying order #%d: client=%s, req_num=%d",
+			s.ReplicaId, s.nextSeq, req.ClientID, req.RequestNum)
+		s.nextSeq++
+		s.appliedSinceCkpt++
+
+		resp, ok := s.applyOnceLocked(req)
+		delete(s.pending, key)
+		if !ok {
+			continue
+		}
+		if ch, ok := s.waiters[key]; ok {
+			ch <- resp
+			delete(s.waiters, key)
+		}
+	}
+
+	if len(s.orderBuf) > 0 {
+		log.Printf("[SERVER][%s] holding %d out-of-order requests, waiting for order #%d",
+			s.ReplicaId, len(s.orderBuf), s.nextSeq)
+	}
+}
+
+// applyOnceLocked applies a request unless the reply cache shows the client's
+// request was already applied, in which case the cached reply is returned. The
+// bool is false for requests older than the cached one, which have no reply.
+// Caller must hold s.mu
+func (s *server) applyOnceLocked(req RequestMessage) (ResponseMessage, bool) {
+	if last, ok := s.replies[req.ClientID]; ok && last.RequestNum >= req.RequestNum {
+		if last.RequestNum > req.RequestNum {
+			log.Printf("[SERVER][%s] skip stale request: client=%s, req_num=%d < last applied %d",
+				s.ReplicaId, req.ClientID, req.RequestNum, last.RequestNum)
+			return ResponseMessage{}, false
+		}
+		log.Printf("[SERVER][%s] skip duplicate request: client=%s, req_num=%d, not re-applied",
+			s.ReplicaId, req.ClientID, req.RequestNum)
+		last.ServerID = s.ReplicaId
+		return last, true
+	}
+	resp := s.applyLocked(req)
+	s.replies[req.ClientID] = resp
+	return resp, true
+}
+
+// replayLogLocked applies the request log of a newly promoted passive backup,
+// i.e. every request the old primary processed after its last checkpoint
+// Caller must hold s.mu
+func (s *server) replayLogLocked() {
+	if len(s.orderBuf) == 0 {
+		return
+	}
+	log.Printf("[SERVER][%s] replaying %d logged requests since checkpoint #%d",
+		s.ReplicaId, len(s.orderBuf), s.CheckpointNo)
+	s.applyOrderedLocked()
+	if len(s.orderBuf) > 0 {
+		log.Printf("[SERVER][%s] discarding %d logged requests beyond gap at #%d",
+			s.ReplicaId, len(s.orderBuf), s.nextSeq)
+		s.orderBuf = make(map[int]RequestMessage)
+	}
+}
+
+// sequencePending orders the requests this replica holds that the previous
+// sequencer never ordered. Called after promotion in active mode.
+func (s *server) sequencePending() {
+	s.mu.Lock()
+	if len(s.orderBuf) > 0 {
+		log.Printf("[SERVER][%s] discarding %d orders beyond gap at #%d from previous sequencer",
+			s.ReplicaId, len(s.orderBuf), s.nextSeq)
+		s.orderBuf = make(map[int]RequestMessage)
+	}
+	reqs := make([]RequestMessage, 0, len(s.pending))
+	for _, req := range s.pending {
+		reqs = append(reqs, req)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].ClientID != reqs[j].ClientID {
+			return reqs[i].ClientID < reqs[j].ClientID
+		}
+		return reqs[i].RequestNum < reqs[j].RequestNum
+	})
+	if len(reqs) > 0 {
+		log.Printf("[SERVER][%s] sequencing %d pending requests left by previous sequencer", s.ReplicaId, len(reqs))
+	}
+	for _, req := range reqs {
+		s.sequence(req)
+	}
+}
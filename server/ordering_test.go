@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startActivePair runs a sequencer S1 and a peer S2 in active mode
+func startActivePair(t *testing.T) (*server, *server) {
+	t.Helper()
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	peers := map[string]string{"S1": addr1, "S2": addr2}
+	copyPeers := func() map[string]string {
+		m := make(map[string]string, len(peers))
+		for id, addr := range peers {
+			m[id] = addr
+		}
+		return m
+	}
+	policy := CheckpointPolicy{Interval: time.Minute}
+	s1 := NewServer(addr1, "S1", NewKVStore(), Primary, Active, copyPeers(), nil, policy, "", FsyncBatch).(*server)
+	go func() {
+		_ = s1.Run()
+	}()
+	waitFor(t, 10*time.Second, "S1 ready", s1.isReady)
+
+	s2 := NewServer(addr2, "S2", NewKVStore(), Backup, Active, copyPeers(), nil, policy, "", FsyncBatch).(*server)
+	go func() {
+		_ = s2.Run()
+	}()
+	waitFor(t, 10*time.Second, "S2 ready", s2.isReady)
+	return s1, s2
+}
+
+func put(t *testing.T, s *server, clientID string, num int, command string) {
+	t.Helper()
+	resp, ok := s.orderRequest(RequestMessage{Type: Req, ClientID: clientID, RequestNum: num, Message: command})
+	if !ok || resp.Message != kvOK {
+		t.Fatalf("%s on %s = %q, %v, want %q", command, s.ReplicaId, resp.Message, ok, kvOK)
+	}
+}
+
+func (s *server) appliedThrough() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextSeq - 1
+}
+
+func TestActivePeerCatchesUpAfterRedial(t *testing.T) {
+	s1, s2 := startActivePair(t)
+	put(t, s1, "C1", 1, "PUT a 1")
+	waitFor(t, 5*time.Second, "S2 to apply #1", func() bool { return s2.appliedThrough() == 1 })
+
+	// Drop the channel; the next ORDER is lost and the sequencer redials without state
+	s1.mu.Lock()
+	old := s1.BackupConns["S2"]
+	s1.mu.Unlock()
+	_ = old.Close()
+	put(t, s1, "C1", 2, "PUT b 2")
+	waitFor(t, 5*time.Second, "S1 to redial S2", func() bool {
+		s1.mu.Lock()
+		defer s1.mu.Unlock()
+		c, ok := s1.BackupConns["S2"]
+		return ok && c != old
+	})
+	if got := s2.appliedThrough(); got != 1 {
+		t.Fatalf("S2 applied through #%d before the gap was noticed, want #1", got)
+	}
+
+	put(t, s1, "C1", 3, "PUT c 3")
+	waitFor(t, 10*time.Second, "S2 to catch up", func() bool { return s2.appliedThrough() == 3 })
+
+	// Later orders keep flowing on the channel the catch-up opened
+	put(t, s1, "C2", 1, "PUT d 4")
+	waitFor(t, 5*time.Second, "S2 to apply #4", func() bool { return s2.appliedThrough() == 4 })
+
+	s2.mu.Lock()
+	defer s2.mu.Unlock()
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"} {
+		if got := s2.App.Apply("GET " + key); got != want {
+			t.Errorf("GET %s on S2 = %q, want %q", key, got, want)
+		}
+	}
+	if len(s2.orderBuf) != 0 {
+		t.Errorf("S2 still holds %d orders", len(s2.orderBuf))
+	}
+}
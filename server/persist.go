@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const checkpointFile = "checkpoint"
+
+// checkpointStore keeps the latest checkpoint on disk. The file is a CRC32
+// (hex) line followed by the JSON checkpoint; it is replaced atomically by
+// writing a temp file, fsyncing it, renaming it and fsyncing the directory.
+type checkpointStore struct {
+	dir string
+	mu  sync.Mutex // Serializes writers of the temp file
+}
+
+func newCheckpointStore(dir string) (*checkpointStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &checkpointStore{dir: dir}, nil
+}
+
+func (cs *checkpointStore) Save(ckpt CheckpointMessage) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	payload, err := json.Marshal(ckpt)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%08x\n", crc32.ChecksumIEEE(payload))
+	buf.Write(payload)
+
+	path := filepath.Join(cs.dir, checkpointFile)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(cs.dir)
+}
+
+// Load returns the persisted checkpoint; the bool is false if none exists
+func (cs *checkpointStore) Load() (CheckpointMessage, bool, error) {
+	var ckpt CheckpointMessage
+	data, err := os.ReadFile(filepath.Join(cs.dir, checkpointFile))
+	if os.IsNotExist(err) {
+		return ckpt, false, nil
+	}
+	if err != nil {
+		return ckpt, false, err
+	}
+	header, payload, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		return ckpt, false, fmt.Errorf("checkpoint file has no checksum header")
+	}
+	sum, err := strconv.ParseUint(string(header), 16, 32)
+	if err != nil {
+		return ckpt, false, fmt.Errorf("bad checksum header: %w", err)
+	}
+	if crc32.ChecksumIEEE(payload) != uint32(sum) {
+		return ckpt, false, fmt.Errorf("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &ckpt); err != nil {
+		return ckpt, false, err
+	}
+	return ckpt, true, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
+
+// loadFromDisk restores the latest persisted checkpoint, overriding the
+// application's initial state. Called from NewServer before serving.
+func (s *server) loadFromDisk() {
+	ckpt, ok, err := s.store.Load()
+	if err != nil {
+		log.Printf("[SERVER][%s] ignoring unreadable checkpoint in %s: %v", s.ReplicaId, s.store.dir, err)
+		return
+	}
+	if !ok {
+		log.Printf("[SERVER][%s] no checkpoint in %s", s.ReplicaId, s.store.dir)
+		return
+	}
+	if err := s.App.Restore(ckpt.State); err != nil {
+		log.Printf("[SERVER][%s] ignoring checkpoint in %s, restore failed: %v", s.ReplicaId, s.store.dir, err)
+		return
+	}
+	s.CheckpointNo = ckpt.CheckpointNum
+	s.nextSeq = ckpt.LastSeq + 1
+	for clientID, resp := range ckpt.Replies {
+		s.replies[clientID] = resp
+	}
+	log.Printf("[SERVER][%s] loaded checkpoint #%d from %s (state=%d bytes, last_seq=%d), overriding initial state",
+		s.ReplicaId, ckpt.CheckpointNum, s.store.dir, len(ckpt.State), ckpt.LastSeq)
+}
+
+// persistCheckpoint writes a checkpoint to disk if a data directory is configured
+func (s *server) persistCheckpoint(ckpt CheckpointMessage) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.Save(ckpt); err != nil {
+		log.Printf("[SERVER][%s] persist checkpoint #%d failed: %v", s.ReplicaId, ckpt.CheckpointNum, err)
+		return
+	}
+	log.Printf("[SERVER][%s] checkpoint #%d persisted to %s", s.ReplicaId, ckpt.CheckpointNum, s.store.dir)
+	if s.wal != nil {
+		if err := s.wal.TruncateThrough(ckpt.LastSeq); err != nil {
+			log.Printf("[SERVER][%s] WAL truncation through #%d failed: %v", s.ReplicaId, ckpt.LastSeq, err)
+		}
+	}
+}
+
+// snapshotLocked captures the current state as a checkpoint with the given number
+// Caller must hold s.mu
+func (s *server) snapshotLocked(num int) (CheckpointMessage, error) {
+	state, err := s.App.Snapshot()
+	if err != nil {
+		return CheckpointMessage{}, err
+	}
+	return CheckpointMessage{
+		Type:          Checkpoint,
+		ReplicaId:     s.ReplicaId,
+		State:         state,
+		CheckpointNum: num,
+		LastSeq:       s.nextSeq - 1,
+		Replies:       s.copyRepliesLocked(),
+	}, nil
+}
+
+// persistLoop periodically persists a local checkpoint. Active replicas never
+// exchange checkpoints, so this is their only durable state.
+func (s *server) persistLoop() {
+	t := time.NewTicker(s.CheckpointFreq)
+	defer t.Stop()
+	for range t.C {
+		s.mu.Lock()
+		if !s.ready {
+			s.mu.Unlock()
+			continue
+		}
+		s.CheckpointNo++
+		ckpt, err := s.snapshotLocked(s.CheckpointNo)
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("[SERVER][%s] snapshot failed, skip local checkpoint: %v", s.ReplicaId, err)
+			continue
+		}
+		s.persistCheckpoint(ckpt)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wenyinh/18749-project/protocol"
+	"github.com/wenyinh/18749-project/utils"
+)
+
+const (
+	// checkpointPollFreq is how often a passive primary checks whether a checkpoint is due
+	checkpointPollFreq = 50 * time.Millisecond
+	// adaptiveRange bounds the adaptive interval to [Interval/adaptiveRange, Interval*adaptiveRange]
+	adaptiveRange = 4
+	// adaptiveBusyRequests is how many requests between checkpoints count as busy
+	// when no request threshold is configured
+	adaptiveBusyRequests = 20
+)
+
+// CheckpointPolicy decides when a passive primary checkpoints: after Interval
+// or after Requests applied requests (0 = time only), whichever comes first.
+// With Adaptive set, the interval shrinks while requests pour in (shorter
+// replay on failover) and grows while backups lag or the group is idle (less
+// bandwidth), within [Interval/4, Interval*4].
+type CheckpointPolicy struct {
+	Interval  time.Duration
+	Requests  int
+	Adaptive  bool
+	FullEvery int // Every FullEvery-th checkpoint is a full snapshot, the rest are deltas
+}
+
+func (p CheckpointPolicy) String() string {
+	return fmt.Sprintf("interval=%v requests=%d adaptive=%v full_every=%d",
+		p.Interval, p.Requests, p.Adaptive, p.FullEvery)
+}
+
+// TruncatesWAL reports whether the policy ever persists a checkpoint, the only
+// time the WAL shrinks. Active replicas persist on Interval alone.
+func (p CheckpointPolicy) TruncatesWAL(mode Mode) bool {
+	if mode == Active {
+		return p.Interval > 0
+	}
+	return p.Interval > 0 || p.Requests > 0
+}
+
+// policyLocked returns the current checkpoint policy
+// Caller must hold s.mu
+func (s *server) policyLocked() CheckpointPolicy {
+	return CheckpointPolicy{
+		Interval:  s.CheckpointFreq,
+		Requests:  s.CheckpointReqs,
+		Adaptive:  s.Adaptive,
+		FullEvery: s.FullEvery,
+	}
+}
+
+// checkpointIntervalLocked is the interval currently in effect
+// Caller must hold s.mu
+func (s *server) checkpointIntervalLocked() time.Duration {
+	if s.Adaptive && s.adaptiveFreq > 0 {
+		return s.adaptiveFreq
+	}
+	return s.CheckpointFreq
+}
+
+// checkpointDue reports whether the policy calls for a checkpoint now
+func (s *server) checkpointDue() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.CheckpointReqs > 0 && s.appliedSinceCkpt >= s.CheckpointReqs {
+		return true
+	}
+	interval := s.checkpointIntervalLocked()
+	return interval > 0 && time.Since(s.lastCkptAt) >= interval
+}
+
+// adaptCheckpointFreqLocked adjusts the adaptive interval once per checkpoint
+// from the requests applied since the previous one and the backups' lag
+// Caller must hold s.mu
+func (s *server) adaptCheckpointFreqLocked() {
+	if !s.Adaptive || s.CheckpointFreq <= 0 {
+		return
+	}
+	if s.adaptiveFreq <= 0 {
+		s.adaptiveFreq = s.CheckpointFreq
+	}
+	busy := adaptiveBusyRequests
+	if s.CheckpointReqs > 0 {
+		busy = (s.CheckpointReqs + 1) / 2
+	}
+
+	next := s.adaptiveFreq
+	reason := ""
+	switch {
+	case s.maxBackupLagLocked() >= 2:
+		next *= 2
+		reason = "backups lagging"
+	case s.appliedSinceCkpt == 0:
+		next *= 2
+		reason = "idle"
+	case s.appliedSinceCkpt >= busy:
+		next /= 2
+		reason = "busy"
+	}
+	lo, hi := s.CheckpointFreq/adaptiveRange, s.CheckpointFreq*adaptiveRange
+	if next < lo {
+		next = lo
+	}
+	if next > hi {
+		next = hi
+	}
+	if next != s.adaptiveFreq {
+		log.Printf("[SERVER][%s] adaptive checkpoint interval %v -> %v (%s: %d requests in %v)",
+			s.ReplicaId, s.adaptiveFreq, next, reason, s.appliedSinceCkpt, time.Since(s.lastCkptAt).Round(time.Millisecond))
+		s.adaptiveFreq = next
+	}
+}
+
+// maxBackupLagLocked is the largest checkpoint lag among connected backups
+// Caller must hold s.mu
+func (s *server) maxBackupLagLocked() int {
+	lag := 0
+	for _, st := range s.backupStatusLocked() {
+		if st.Connected && st.CheckpointLag > lag {
+			lag = st.CheckpointLag
+		}
+	}
+	return lag
+}
+
+// handlePolicy applies a "CKPT_POLICY key=value ..." admin command. Keys are
+// interval (duration), requests, adaptive and full_every; omitted keys keep
+// their value. Answers ACK or an ERROR line.
+func (s *server) handlePolicy(conn net.Conn, args string) {
+	s.mu.Lock()
+	policy := s.policyLocked()
+	s.mu.Unlock()
+
+	for _, kv := range strings.Fields(args) {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			_ = utils.WriteLine(conn, "ERROR: expected key=value, got "+kv)
+			return
+		}
+		var err error
+		switch key {
+		case "interval":
+			policy.Interval, err = time.ParseDuration(value)
+		case "requests":
+			policy.Requests, err = strconv.Atoi(value)
+		case "adaptive":
+			policy.Adaptive, err = strconv.ParseBool(value)
+		case "full_every":
+			policy.FullEvery, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err == nil && (policy.Interval < 0 || policy.Requests < 0) {
+			err = fmt.Errorf("must not be negative")
+		}
+		if err != nil {
+			_ = utils.WriteLine(conn, fmt.Sprintf("ERROR: bad %s: %v", kv, err))
+			return
+		}
+	}
+	if s.wal != nil && !policy.TruncatesWAL(s.ServerMode) {
+		_ = utils.WriteLine(conn, "ERROR: checkpoints cannot be turned off while the WAL is enabled")
+		return
+	}
+
+	s.mu.Lock()
+	s.CheckpointFreq = policy.Interval
+	s.CheckpointReqs = policy.Requests
+	s.Adaptive = policy.Adaptive
+	s.FullEvery = policy.FullEvery
+	s.adaptiveFreq = policy.Interval
+	if s.ServerRole == Primary && s.ready {
+		// Start the loop if checkpointing was off before
+		s.startPrimaryLoopLocked()
+	}
+	s.mu.Unlock()
+	log.Printf("[SERVER][%s] checkpoint policy set: %s", s.ReplicaId, policy)
+	_ = s.send(conn, 0, protocol.Ack{})
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/wenyinh/18749-project/protocol"
+	"github.com/wenyinh/18749-project/utils"
+)
+
+// recoveryTimeout bounds each attempt to fetch state from a peer
+const recoveryTimeout = 5 * time.Second
+
+// recoverState brings a (re)starting replica up to date before it serves clients.
+// It asks each peer for state; the live primary quiesces, answers with a checkpoint
+// and opens its secondary channel to us, so requests ordered after the checkpoint
+// are logged here and replayed once it is installed. If no primary answers, the
+// replica starts from what it loaded from disk, or from its initial state.
+func (s *server) recoverState() {
+	s.mu.Lock()
+	peers := make([]string, 0, len(s.Backups))
+	for id := range s.Backups {
+		if id != s.ReplicaId {
+			peers = append(peers, id)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(peers)
+
+	for _, id := range peers {
+		s.mu.Lock()
+		addr := s.Backups[id]
+		s.mu.Unlock()
+
+		ckpt, err := s.requestState(id, addr)
+		if err != nil {
+			log.Printf("[SERVER][%s] state transfer from %s@%s failed: %v", s.ReplicaId, id, addr, err)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.ready {
+			// Promoted while we were asking
+			s.mu.Unlock()
+			return
+		}
+		if s.ServerRole == Primary {
+			log.Printf("[SERVER][%s] %s is already primary, joining as BACKUP", s.ReplicaId, ckpt.ReplicaId)
+			s.ServerRole = Backup
+		}
+		log.Printf("[SERVER][%s] recovered from %s: state=%d bytes, checkpoint_no=%d, last_seq=%d, replaying %d logged orders",
+			s.ReplicaId, ckpt.ReplicaId, len(ckpt.State), ckpt.CheckpointNum, ckpt.LastSeq, len(s.orderBuf))
+		if err := s.installCheckpointLocked(ckpt); err != nil {
+			s.mu.Unlock()
+			log.Printf("[SERVER][%s] install recovery checkpoint from %s failed: %v", s.ReplicaId, id, err)
+			continue
+		}
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ready {
+		if s.CheckpointNo > 0 || s.nextSeq > 1 {
+			log.Printf("[SERVER][%s] no primary available for state transfer, starting from disk state (checkpoint_no=%d, last_seq=%d)",
+				s.ReplicaId, s.CheckpointNo, s.nextSeq-1)
+		} else {
+			log.Printf("[SERVER][%s] no primary available for state transfer, starting from initial state",
+				s.ReplicaId)
+		}
+		s.markReadyLocked()
+	}
+}
+
+// requestState sends STATE_REQ to one peer and waits for its checkpoint
+func (s *server) requestState(id, addr string) (CheckpointMessage, error) {
+	var ckpt CheckpointMessage
+	conn, err := utils.Dial(addr, recoveryTimeout)
+	if err != nil {
+		return ckpt, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	payload, err := json.Marshal(StateRequestMessage{Type: StateReq, ReplicaId: s.ReplicaId})
+	if err != nil {
+		return ckpt, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(recoveryTimeout))
+	log.Printf("[SERVER][%s] requesting state from %s@%s", s.ReplicaId, id, addr)
+	if err := utils.WriteLine(conn, string(payload)); err != nil {
+		return ckpt, err
+	}
+	r := bufio.NewReader(conn)
+	reply, err := utils.ReadLine(r)
+	if err != nil {
+		return ckpt, err
+	}
+	var mt MessageType
+	if json.Unmarshal([]byte(reply), &mt) == nil && mt.Type == CheckpointBegin {
+		return s.receiveChunked(conn, r, reply)
+	}
+	env, err := protocol.Decode(reply)
+	if err != nil {
+		return ckpt, fmt.Errorf("unexpected reply: %s", reply)
+	}
+	if env.Type == Nack {
+		return ckpt, fmt.Errorf("%s is not a ready primary", id)
+	}
+	return decodeCheckpoint(reply)
+}
+
+// receiveChunked assembles a recovery checkpoint streamed in chunks, acking
+// every step like a backup does on its secondary channel
+func (s *server) receiveChunked(conn net.Conn, r *bufio.Reader, line string) (CheckpointMessage, error) {
+	var in *incomingCheckpoint
+	for {
+		var msg CheckpointChunkMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			return CheckpointMessage{}, fmt.Errorf("unexpected reply: %s", line)
+		}
+		switch msg.Type {
+		case CheckpointBegin:
+			in = &incomingCheckpoint{
+				from:     msg.ReplicaId,
+				num:      msg.CheckpointNum,
+				total:    msg.Total,
+				checksum: msg.Checksum,
+				data:     make([]byte, 0, msg.Total),
+			}
+			log.Printf("[SERVER][%s] receiving recovery checkpoint from %s in chunks (%d bytes)",
+				s.ReplicaId, msg.ReplicaId, msg.Total)
+		case CheckpointChunk:
+			if in == nil || in.num != msg.CheckpointNum {
+				return CheckpointMessage{}, fmt.Errorf("chunk of checkpoint #%d without CKPT_BEGIN", msg.CheckpointNum)
+			}
+			if err := in.add(msg); err != nil {
+				log.Printf("[SERVER][%s] drop chunk of recovery checkpoint: %v, have %d bytes",
+					s.ReplicaId, err, len(in.data))
+			}
+		case CheckpointEnd:
+			if in == nil || len(in.data) != in.total {
+				return CheckpointMessage{}, fmt.Errorf("recovery checkpoint incomplete at CKPT_END")
+			}
+			return decodeChunked(in)
+		default:
+			return CheckpointMessage{}, fmt.Errorf("unexpected %s during chunked transfer", msg.Type)
+		}
+		s.sendChunkAck(conn, in.num, len(in.data))
+
+		_ = conn.SetDeadline(time.Now().Add(recoveryTimeout))
+		var err error
+		if line, err = utils.ReadLine(r); err != nil {
+			return CheckpointMessage{}, err
+		}
+	}
+}
+
+// handleStateRequest answers a joining replica with an immediate checkpoint.
+// Sequencing is paused while the secondary channel to the joiner is opened and
+// the state is captured, so every later order reaches the joiner.
+func (s *server) handleStateRequest(conn *utils.Conn, req StateRequestMessage) {
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+
+	s.mu.Lock()
+	addr, known := s.Backups[req.ReplicaId]
+	ok := s.ServerRole == Primary && s.ready
+	s.mu.Unlock()
+	if !ok {
+		log.Printf("[SERVER][%s] not a ready primary, reject state request from %s", s.ReplicaId, req.ReplicaId)
+		_ = s.send(conn, 0, protocol.Nack{Reason: "not a ready primary"})
+		return
+	}
+
+	log.Printf("[SERVER][%s] quiescing for recovery of %s", s.ReplicaId, req.ReplicaId)
+	if known {
+		s.dialBackup(req.ReplicaId, addr, true)
+	} else {
+		log.Printf("[SERVER][%s] %s is not in the backup list, it will not receive later updates",
+			s.ReplicaId, req.ReplicaId)
+	}
+
+	s.mu.Lock()
+	ckpt, err := s.snapshotLocked(s.CheckpointNo)
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("[SERVER][%s] snapshot failed, cannot recover %s: %v", s.ReplicaId, req.ReplicaId, err)
+		_ = s.send(conn, 0, protocol.Nack{Reason: "snapshot failed"})
+		return
+	}
+
+	line, err := encodeCheckpoint(ckpt)
+	if err != nil {
+		log.Printf("[SERVER][%s] marshal checkpoint failed: %v", s.ReplicaId, err)
+		return
+	}
+	if len(line) > checkpointChunkSize {
+		payload := []byte(line)
+		err = s.sendRecoveryChunked(conn, &outgoingCheckpoint{num: ckpt.CheckpointNum, payload: payload, checksum: crc32.ChecksumIEEE(payload)})
+	} else {
+		err = utils.WriteLine(conn, line)
+	}
+	if err != nil {
+		log.Printf("[SERVER][%s] send recovery checkpoint to %s failed: %v", s.ReplicaId, req.ReplicaId, err)
+		return
+	}
+	log.Printf("[SERVER][%s] recovery checkpoint sent to %s (state=%d bytes, last_seq=%d), resuming",
+		s.ReplicaId, req.ReplicaId, len(ckpt.State), ckpt.LastSeq)
+}
+
+// sendRecoveryChunked streams a recovery checkpoint on the joiner's request
+// connection. The joiner's chunk acks are read here until the transfer ends;
+// the connection's own loop reads it again afterwards.
+func (s *server) sendRecoveryChunked(conn *utils.Conn, out *outgoingCheckpoint) error {
+	acks := make(chan CheckpointChunkMessage, 2*checkpointWindow/checkpointChunkSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(acks)
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var ack CheckpointChunkMessage
+			if msg.Type != CheckpointChunkAck || json.Unmarshal([]byte(msg.Payload), &ack) != nil {
+				log.Printf("[SERVER][%s] unexpected %s during recovery transfer", s.ReplicaId, msg.Type)
+				continue
+			}
+			select {
+			case acks <- ack:
+			default:
+			}
+		}
+	}()
+
+	err := s.streamChunks(conn, out, acks)
+	// Stop the ack reader
+	_ = conn.SetReadDeadline(time.Now())
+	<-done
+	_ = conn.SetReadDeadline(time.Time{})
+	return err
+}
+
+// markReadyLocked lets the replica serve clients and, if it is primary, starts the primary loop
+// Caller must hold s.mu
+func (s *server) markReadyLocked() {
+	s.ready = true
+	green := "\033[32m"
+	reset := "\033[0m"
+	log.Printf("%s[SERVER][%s] READY (role=%s, checkpoint_no=%d, last_seq=%d)%s",
+		green, s.ReplicaId, s.ServerRole, s.CheckpointNo, s.nextSeq-1, reset)
+	if s.ServerRole == Primary {
+		s.startPrimaryLoopLocked()
+	}
+}
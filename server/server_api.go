@@ -3,3 +3,25 @@ package server
 type Server interface {
 	Run() error
 }
+
+// StateMachine is the replicated application run by a server. The server
+// orders, logs, checkpoints and replays requests; the application only has to
+// apply commands deterministically and serialize its state.
+type StateMachine interface {
+	// Apply executes one client command and returns the reply message
+	Apply(command string) string
+	// Snapshot serializes the full application state for a checkpoint
+	Snapshot() ([]byte, error)
+	// Restore replaces the application state with a snapshot
+	Restore(snapshot []byte) error
+}
+
+// DeltaStateMachine is a StateMachine that can also checkpoint incrementally.
+// The primary sends deltas between periodic full snapshots.
+type DeltaStateMachine interface {
+	StateMachine
+	// Delta serializes the changes since the previous Delta call and starts tracking anew
+	Delta() ([]byte, error)
+	// ApplyDelta applies changes produced by Delta on another replica
+	ApplyDelta(delta []byte) error
+}
@@ -1,26 +1,42 @@
 package server
 
 import (
-	"bufio"
 	"encoding/json"
+	"hash/crc32"
 	"log"
 	"net"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/wenyinh/18749-project/protocol"
 	"github.com/wenyinh/18749-project/utils"
 )
 
 const (
-	Ping       = "PING"
-	Pong       = "PONG"
-	Req        = "REQ"
-	Resp       = "RESP"
-	Register   = "REGISTER"
-	Ack        = "ACK"
-	Nack       = "NACK"
-	Checkpoint = "CHECKPOINT"
+	Ping       = protocol.TypePing
+	Pong       = protocol.TypePong
+	Req        = protocol.TypeReq
+	Resp       = protocol.TypeResp
+	Register   = protocol.TypeRegister
+	Hello      = protocol.TypeHello
+	Ack        = protocol.TypeAck
+	Nack       = protocol.TypeNack
+	Checkpoint = protocol.TypeCheckpoint
+	Promote    = "PROMOTE"
+	Demote     = "DEMOTE"
+	Order      = "ORDER"
+	StateReq   = "STATE_REQ"
+
+	CheckpointAck     = "CHECKPOINT_ACK"
+	FullCheckpointReq = "FULL_CHECKPOINT_REQ"
+
+	CheckpointBegin     = "CKPT_BEGIN"
+	CheckpointChunk     = "CKPT_CHUNK"
+	CheckpointEnd       = "CKPT_END"
+	CheckpointChunkAck  = "CKPT_CHUNK_ACK"
+	Status              = "STATUS"
+	CheckpointPolicyCmd = "CKPT_POLICY"
+	CheckpointNow       = "CHECKPOINT_NOW"
 )
 
 type Role int
@@ -30,6 +46,29 @@ const (
 	Backup
 )
 
+func (r Role) String() string {
+	if r == Primary {
+		return "primary"
+	}
+	return "backup"
+}
+
+// Mode selects the replication style: passive (primary + checkpoints) or
+// active (every replica executes every request in sequencer order)
+type Mode int
+
+const (
+	Passive Mode = iota
+	Active
+)
+
+func (m Mode) String() string {
+	if m == Active {
+		return "active"
+	}
+	return "passive"
+}
+
 type RequestMessage struct {
 	Type       string `json:"type"`
 	ClientID   string `json:"client_id"`
@@ -38,31 +77,81 @@ type RequestMessage struct {
 }
 
 type ResponseMessage struct {
-	Type        string `json:"type"`
-	ServerID    string `json:"server_id"`
-	ClientID    string `json:"client_id"`
-	RequestNum  int    `json:"request_num"`
-	ServerState int    `json:"server_state"`
-	Message     string `json:"message"`
+	Type       string `json:"type"`
+	ServerID   string `json:"server_id"`
+	ClientID   string `json:"client_id"`
+	RequestNum int    `json:"request_num"`
+	Message    string `json:"message"` // Reply from the state machine
 }
 
 type CheckpointMessage struct {
 	Type          string `json:"type"`
 	ReplicaId     string `json:"replica_id"`
-	ServerState   int    `json:"server_state"`
+	State         []byte `json:"state"` // StateMachine snapshot
 	CheckpointNum int    `json:"checkpoint_num"`
+	LastSeq       int    `json:"last_seq"` // Last ordered request reflected in State
+	// Replies is the per-client reply cache, so duplicates are still detected after failover
+	Replies map[string]ResponseMessage `json:"replies,omitempty"`
+	// Delta marks State as the changes since checkpoint BaseNum (see DeltaStateMachine)
+	Delta   bool `json:"delta,omitempty"`
+	BaseNum int  `json:"base_num,omitempty"`
+}
+
+// StateRequestMessage is sent by a joining replica to ask the primary for its state
+type StateRequestMessage struct {
+	Type      string `json:"type"`
+	ReplicaId string `json:"replica_id"`
+}
+
+// OrderMessage assigns a client request its position in the total order.
+// The primary sends one to every peer: in active mode peers apply it, in
+// passive mode backups log it until the next checkpoint covers it.
+type OrderMessage struct {
+	Type      string         `json:"type"`
+	ReplicaId string         `json:"replica_id"`
+	Seq       int            `json:"seq"`
+	Request   RequestMessage `json:"request"`
 }
 
 type server struct {
-	Addr           string
-	ReplicaId      string
-	ServerState    int
-	ServerRole     Role
-	Backups        map[string]string
-	BackupConns    map[string]net.Conn
-	CheckpointFreq time.Duration
-	CheckpointNo   int
-	mu             sync.Mutex
+	Addr             string
+	ReplicaId        string
+	App              StateMachine
+	ServerRole       Role
+	ServerMode       Mode
+	Backups          map[string]string
+	BackupConns      map[string]net.Conn
+	acks             map[string]backupAck     // Latest checkpoint acked by each backup (primary only)
+	outgoing         *outgoingCheckpoint      // Latest chunked checkpoint (primary only)
+	progress         map[string]chunkProgress // Chunked transfer progress per backup (primary only)
+	incoming         *incomingCheckpoint      // Partially received chunked checkpoint (backup only)
+	CheckpointFreq   time.Duration
+	CheckpointReqs   int  // Checkpoint after this many applied requests; 0 = time only
+	Adaptive         bool // Adapt the checkpoint interval to request rate and backup lag
+	CheckpointNo     int
+	FullEvery        int              // Every FullEvery-th checkpoint is a full snapshot, the rest are deltas
+	adaptiveFreq     time.Duration    // Interval in effect in adaptive mode
+	lastCkptAt       time.Time        // When the primary last checkpointed
+	appliedSinceCkpt int              // Requests applied since the last checkpoint
+	lastFullNo       int              // Number of the last full checkpoint sent as primary
+	needFull         bool             // The next checkpoint must be a full snapshot
+	stopPrimary      chan struct{}    // Closed to stop the primary loop; nil while not running
+	ready            bool             // False while recovering state; client requests are refused
+	store            *checkpointStore // Durable checkpoints; nil without a data directory
+	wal              *writeAheadLog   // Requests applied since the persisted checkpoint; nil without a data directory
+	walErr           error            // Set once a WAL append failed; the replica stops serving for good
+
+	// Request ordering state
+	nextSeq    int                             // Next sequence number to apply
+	orderBuf   map[int]RequestMessage          // Ordered requests not yet applied (passive backups: request log)
+	pending    map[string]RequestMessage       // Requests received from clients but not yet applied
+	waiters    map[string]chan ResponseMessage // Client connections waiting for their request to be applied
+	replies    map[string]ResponseMessage      // Reply cache: response to the highest applied request per client
+	orderMu    sync.Mutex                      // Serializes sequencing so peers see orders in seq order
+	catchingUp bool                            // Fetching state from the sequencer after an order gap (active mode)
+	ckptMu     sync.Mutex                      // Serializes checkpoint sends so backups see them in order
+
+	mu sync.Mutex
 }
 
 type MessageType struct {
@@ -71,11 +160,14 @@ type MessageType struct {
 
 func NewServer(
 	addr, replicaId string,
-	serverState int,
+	app StateMachine,
 	role Role,
+	mode Mode,
 	backups map[string]string,
 	backupConns map[string]net.Conn,
-	ckptFreq time.Duration,
+	policy CheckpointPolicy,
+	dataDir string,
+	fsync FsyncPolicy,
 ) Server {
 	if backups == nil {
 		backups = make(map[string]string)
@@ -86,12 +178,42 @@ func NewServer(
 	s := &server{
 		Addr:           addr,
 		ReplicaId:      replicaId,
-		ServerState:    serverState,
+		App:            app,
 		ServerRole:     role,
+		ServerMode:     mode,
 		Backups:        backups,
 		BackupConns:    backupConns,
-		CheckpointFreq: ckptFreq,
+		CheckpointFreq: policy.Interval,
+		CheckpointReqs: policy.Requests,
+		Adaptive:       policy.Adaptive,
+		FullEvery:      policy.FullEvery,
+		adaptiveFreq:   policy.Interval,
+		needFull:       true,
 		CheckpointNo:   0,
+		nextSeq:        1,
+		orderBuf:       make(map[int]RequestMessage),
+		pending:        make(map[string]RequestMessage),
+		waiters:        make(map[string]chan ResponseMessage),
+		replies:        make(map[string]ResponseMessage),
+		acks:           make(map[string]backupAck),
+		progress:       make(map[string]chunkProgress),
+	}
+	if dataDir != "" {
+		store, err := newCheckpointStore(dataDir)
+		if err != nil {
+			log.Printf("[SERVER][%s] cannot use data dir %s, checkpoints stay in memory: %v", replicaId, dataDir, err)
+		} else {
+			s.store = store
+			s.loadFromDisk()
+		}
+		wal, records, err := openWAL(dataDir, fsync)
+		if err != nil {
+			log.Printf("[SERVER][%s] cannot open WAL in %s, requests are not logged: %v", replicaId, dataDir, err)
+		} else {
+			s.wal = wal
+			s.replayWAL(records)
+			log.Printf("[SERVER][%s] WAL enabled in %s (fsync=%s)", replicaId, dataDir, fsync)
+		}
 	}
 	return s
 }
@@ -100,13 +222,20 @@ func (s *server) handleConnection(conn net.Conn) {
 	defer func() {
 		_ = conn.Close()
 	}()
-	r := bufio.NewReader(conn)
 	log.Printf("[SERVER][%s] connected to %s", s.ReplicaId, conn.RemoteAddr())
 
+	c, err := utils.Accept(conn)
+	if err != nil {
+		return
+	}
+	if c.Framed() {
+		log.Printf("[SERVER][%s] %s uses framed messages", s.ReplicaId, conn.RemoteAddr())
+	}
+
 	isLFDConnection := false
 
 	for {
-		line, err := utils.ReadLine(r)
+		msg, err := c.ReadMessage()
 		if err != nil {
 			if isLFDConnection {
 				log.Printf("[SERVER][%s] LFD disconnected from %s", s.ReplicaId, conn.RemoteAddr())
@@ -114,115 +243,347 @@ func (s *server) handleConnection(conn net.Conn) {
 			return
 		}
 
-		// Check if this is a REGISTER message from LFD
-		if len(line) >= len(Register) && line[:len(Register)] == Register {
-			parts := strings.Fields(line)
-			if len(parts) == 2 {
-				requestedServerID := parts[1]
-				if requestedServerID == s.ReplicaId {
-					// Server ID matches, acknowledge
-					err := utils.WriteLine(conn, Ack)
-					if err == nil {
-						isLFDConnection = true
-						log.Printf("[SERVER][%s] LFD registered successfully to monitor this server", s.ReplicaId)
-					}
-				} else {
-					// Server ID mismatch, reject
-					err := utils.WriteLine(conn, Nack)
-					log.Printf("[SERVER][%s] rejected LFD registration: expected %s but got %s",
-						s.ReplicaId, s.ReplicaId, requestedServerID)
-					if err == nil {
-						return
-					}
+		switch msg.Type {
+		case Register:
+			// REGISTER from LFD
+			env, err := protocol.Decode(msg.Payload)
+			var reg protocol.Register
+			if err == nil {
+				err = env.Unmarshal(&reg)
+			}
+			if err != nil {
+				log.Printf("[SERVER][%s] bad REGISTER from %s: %v", s.ReplicaId, conn.RemoteAddr(), err)
+				continue
+			}
+			agreed, verr := reg.Handshake.Agree()
+			if verr != nil {
+				log.Printf("[SERVER][%s] rejected LFD %s: %v", s.ReplicaId, env.Sender, verr)
+				_ = s.send(c, 0, protocol.Nack{Reason: verr.Error()})
+				return
+			}
+			if reg.ServerID == s.ReplicaId {
+				// Server ID matches, acknowledge
+				err := s.send(c, 0, protocol.Ack{Handshake: agreed})
+				if err == nil {
+					isLFDConnection = true
+					log.Printf("[SERVER][%s] LFD %s registered successfully to monitor this server (protocol v%d, capabilities %v)",
+						s.ReplicaId, env.Sender, agreed.Version, agreed.Capabilities)
+				}
+			} else {
+				// Server ID mismatch, reject
+				err := s.send(c, 0, protocol.Nack{Reason: "this is server " + s.ReplicaId})
+				log.Printf("[SERVER][%s] rejected LFD registration: expected %s but got %s",
+					s.ReplicaId, s.ReplicaId, reg.ServerID)
+				if err == nil {
+					return
 				}
 			}
-			continue
-		}
-
-		if line == Ping {
-			err := utils.WriteLine(conn, Pong)
+		case Hello:
+			s.handleHello(c, msg.Payload)
+		case Promote:
+			s.promote()
+			_ = s.send(c, 0, protocol.Ack{})
+		case Demote:
+			s.demote()
+			_ = s.send(c, 0, protocol.Ack{})
+		case Status:
+			s.handleStatus(c)
+		case CheckpointNow:
+			s.handleCheckpointNow(c)
+		case CheckpointPolicyCmd:
+			s.handlePolicy(c, msg.Payload)
+		case Ping:
+			env, err := protocol.Decode(msg.Payload)
+			if err != nil {
+				log.Printf("[SERVER][%s] bad PING from %s: %v", s.ReplicaId, conn.RemoteAddr(), err)
+				continue
+			}
+			if s.stoppedServing() {
+				log.Printf("[SERVER][%s] stopped serving, not answering heartbeat", s.ReplicaId)
+				continue
+			}
+			err = s.send(c, env.Seq, protocol.Pong{})
 			if err == nil {
 				log.Printf("[SERVER][%s] heartbeat, sent pong to LFD", s.ReplicaId)
 			}
-			continue
-		}
-
-		var mt MessageType
-		if err := json.Unmarshal([]byte(line), &mt); err != nil {
-			log.Printf("[SERVER][%s] failed to parse JSON: %v", s.ReplicaId, err)
-			_ = utils.WriteLine(conn, "ERROR: invalid JSON format")
-			continue
-		}
-
-		switch mt.Type {
 		case Req:
-			var reqMsg RequestMessage
-			if err := json.Unmarshal([]byte(line), &reqMsg); err != nil {
+			reqMsg, err := decodeRequest(msg.Payload)
+			if err != nil {
 				log.Printf("[SERVER][%s] failed to parse JSON: %v", s.ReplicaId, err)
-				_ = utils.WriteLine(conn, "ERROR: invalid JSON format")
+				_ = utils.WriteLine(c, "ERROR: invalid JSON format")
 				continue
 			}
-			if s.ServerRole == Backup {
-				log.Printf("[SERVER][%s] is not primary server, skip handle request: client=%s, req_num=%d",
+			if !s.isReady() {
+				log.Printf("[SERVER][%s] not ready (recovering), refuse request: client=%s, req_num=%d",
 					s.ReplicaId, reqMsg.ClientID, reqMsg.RequestNum)
+				_ = utils.WriteLine(c, "ERROR: replica not ready")
 				continue
 			}
 			log.Printf("[SERVER][%s] received JSON request from client, clientId: %s, request_num: %d, Message: %s",
 				s.ReplicaId, reqMsg.ClientID, reqMsg.RequestNum, reqMsg.Message)
-			s.mu.Lock()
-			replicaId := s.ReplicaId
-			before := s.ServerState
-			s.ServerState++
-			after := s.ServerState
-			s.mu.Unlock()
-			log.Printf("[SERVER][%s] server state before: %d", replicaId, before)
-			log.Printf("[SERVER][%s] server state after: %d", replicaId, after)
-			// Create JSON response
-			respMsg := ResponseMessage{
-				Type:        Resp,
-				ServerID:    replicaId,
-				ClientID:    reqMsg.ClientID,
-				RequestNum:  reqMsg.RequestNum,
-				ServerState: after,
-				Message:     reqMsg.Message,
+			if s.ServerMode == Passive && !s.isPrimary() {
+				log.Printf("[SERVER][%s] is not primary server, skip handle request: client=%s, req_num=%d",
+					s.ReplicaId, reqMsg.ClientID, reqMsg.RequestNum)
+				continue
 			}
-			jsonResp, err := json.Marshal(respMsg)
+			respMsg, ok := s.orderRequest(reqMsg)
+			if !ok {
+				continue
+			}
+			line, err := encodeResponse(respMsg)
 			if err != nil {
 				log.Printf("[SERVER][%s] error marshaling response: %v", s.ReplicaId, err)
-				_ = utils.WriteLine(conn, "ERROR: failed to create response")
+				_ = utils.WriteLine(c, "ERROR: failed to create response")
 				continue
 			}
-			_ = utils.WriteLine(conn, string(jsonResp))
-			log.Printf("[SERVER][%s] sent JSON reply to client, clientId: %s, request_num: %d, server state: %d",
-				s.ReplicaId, reqMsg.ClientID, reqMsg.RequestNum, s.ServerState)
+			_ = utils.WriteLine(c, line)
+			log.Printf("[SERVER][%s] sent JSON reply to client, clientId: %s, request_num: %d, reply: %s",
+				s.ReplicaId, reqMsg.ClientID, reqMsg.RequestNum, respMsg.Message)
 		case Checkpoint:
-			var ckpt CheckpointMessage
-			if err := json.Unmarshal([]byte(line), &ckpt); err != nil {
-				log.Printf("[SERVER][%s] bad CHECKPOINT json: %v", s.ReplicaId, err)
+			ckpt, err := decodeCheckpoint(msg.Payload)
+			if err != nil {
+				log.Printf("[SERVER][%s] bad CHECKPOINT: %v", s.ReplicaId, err)
 				continue
 			}
-			if s.ServerRole == Backup {
-				s.mu.Lock()
-				if ckpt.CheckpointNum <= s.CheckpointNo {
-					s.mu.Unlock()
-					log.Printf("[SERVER][%s] ignore stale checkpoint from %s: recv=%d <= local=%d",
-						s.ReplicaId, ckpt.ReplicaId, ckpt.CheckpointNum, s.CheckpointNo)
-					continue
-				}
-				s.ServerState = ckpt.ServerState
-				s.CheckpointNo = ckpt.CheckpointNum
-				s.mu.Unlock()
-				log.Printf("[SERVER][%s] recv checkpoint from %s: server_state=%d, checkpoint_no=%d",
-					s.ReplicaId, ckpt.ReplicaId, s.ServerState, s.CheckpointNo)
+			s.handleCheckpoint(c, ckpt)
+		case CheckpointBegin, CheckpointChunk, CheckpointEnd:
+			var chunk CheckpointChunkMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &chunk); err != nil {
+				log.Printf("[SERVER][%s] bad %s json: %v", s.ReplicaId, msg.Type, err)
+				continue
 			}
+			s.handleCheckpointTransfer(c, chunk)
+		case StateReq:
+			var req StateRequestMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &req); err != nil {
+				log.Printf("[SERVER][%s] bad STATE_REQ json: %v", s.ReplicaId, err)
+				continue
+			}
+			s.handleStateRequest(c, req)
+		case Order:
+			var ord OrderMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &ord); err != nil {
+				log.Printf("[SERVER][%s] bad ORDER json: %v", s.ReplicaId, err)
+				continue
+			}
+			s.mu.Lock()
+			s.deliverLocked(ord)
+			s.mu.Unlock()
 		default:
-			_ = utils.WriteLine(conn, "ERROR: unknown request type")
+			if !msg.IsJSON() {
+				log.Printf("[SERVER][%s] unknown command from %s: %s", s.ReplicaId, conn.RemoteAddr(), msg)
+				_ = utils.WriteLine(c, "ERROR: invalid JSON format")
+				continue
+			}
+			_ = utils.WriteLine(c, "ERROR: unknown request type")
+		}
+	}
+}
+
+// handleCheckpoint installs a checkpoint received from the primary, whole or
+// reassembled from chunks, and acknowledges it on the same channel
+func (s *server) handleCheckpoint(conn net.Conn, ckpt CheckpointMessage) {
+	if s.ServerMode == Active {
+		log.Printf("[SERVER][%s] active mode, ignore checkpoint from %s", s.ReplicaId, ckpt.ReplicaId)
+		return
+	}
+	if s.isPrimary() {
+		return
+	}
+	s.mu.Lock()
+	if ckpt.CheckpointNum <= s.CheckpointNo {
+		s.mu.Unlock()
+		log.Printf("[SERVER][%s] ignore stale checkpoint from %s: recv=%d <= local=%d",
+			s.ReplicaId, ckpt.ReplicaId, ckpt.CheckpointNum, s.CheckpointNo)
+		// Our state already covers it
+		s.sendCheckpointAck(conn, ckpt)
+		return
+	}
+	if err := s.installCheckpointLocked(ckpt); err != nil {
+		s.mu.Unlock()
+		log.Printf("[SERVER][%s] install checkpoint #%d (%s) from %s failed: %v",
+			s.ReplicaId, ckpt.CheckpointNum, describeCheckpoint(ckpt), ckpt.ReplicaId, err)
+		if ckpt.Delta {
+			s.requestFullCheckpoint(conn, ckpt)
+		}
+		return
+	}
+	s.mu.Unlock()
+	log.Printf("[SERVER][%s] recv checkpoint from %s: state=%d bytes (%s), checkpoint_no=%d",
+		s.ReplicaId, ckpt.ReplicaId, len(ckpt.State), describeCheckpoint(ckpt), ckpt.CheckpointNum)
+	s.sendCheckpointAck(conn, ckpt)
+}
+
+// applyLocked executes one client request against the state machine
+// Caller must hold s.mu
+func (s *server) applyLocked(req RequestMessage) ResponseMessage {
+	reply := s.App.Apply(req.Message)
+	log.Printf("[SERVER][%s] applied '%s' -> '%s'", s.ReplicaId, req.Message, reply)
+	return ResponseMessage{
+		Type:       Resp,
+		ServerID:   s.ReplicaId,
+		ClientID:   req.ClientID,
+		RequestNum: req.RequestNum,
+		Message:    reply,
+	}
+}
+
+// installCheckpointLocked replaces the local state with a checkpoint from the primary
+// Caller must hold s.mu
+func (s *server) installCheckpointLocked(ckpt CheckpointMessage) error {
+	if err := s.restoreLocked(ckpt); err != nil {
+		return err
+	}
+	s.CheckpointNo = ckpt.CheckpointNum
+	s.replies = make(map[string]ResponseMessage, len(ckpt.Replies))
+	for clientID, resp := range ckpt.Replies {
+		s.replies[clientID] = resp
+	}
+	if ckpt.LastSeq >= s.nextSeq {
+		s.nextSeq = ckpt.LastSeq + 1
+	}
+	for seq := range s.orderBuf {
+		if seq < s.nextSeq {
+			delete(s.orderBuf, seq)
+		}
+	}
+	if durable, ok := s.durableCheckpointLocked(ckpt); ok {
+		s.persistCheckpoint(durable)
+	}
+	// Our own log may hold requests the primary never ordered; its checkpoint is authoritative
+	s.resetWAL()
+	if !s.ready && s.walErr == nil {
+		s.markReadyLocked()
+	}
+	s.applyOrderedLocked()
+	return nil
+}
+
+// copyRepliesLocked snapshots the reply cache for a checkpoint
+// Caller must hold s.mu
+func (s *server) copyRepliesLocked() map[string]ResponseMessage {
+	replies := make(map[string]ResponseMessage, len(s.replies))
+	for clientID, resp := range s.replies {
+		replies[clientID] = resp
+	}
+	return replies
+}
+
+func (s *server) isReady() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+func (s *server) stoppedServing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.walErr != nil
+}
+
+func (s *server) isPrimary() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ServerRole == Primary
+}
+
+// promote switches this replica to primary and starts checkpointing to the backups
+func (s *server) promote() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ServerRole == Primary {
+		log.Printf("[SERVER][%s] PROMOTE received but already primary", s.ReplicaId)
+		return
+	}
+	s.ServerRole = Primary
+	// Backups may hold other bases than ours, start them from a snapshot
+	s.needFull = true
+	log.Printf("[SERVER][%s] promoted to PRIMARY (checkpoint_no=%d, last_seq=%d)",
+		s.ReplicaId, s.CheckpointNo, s.nextSeq-1)
+	if !s.ready {
+		log.Printf("[SERVER][%s] promoted during recovery, serving with current state", s.ReplicaId)
+		s.markReadyLocked()
+	}
+	if s.ServerMode == Passive {
+		s.replayLogLocked()
+	}
+	s.startPrimaryLoopLocked()
+	if s.ServerMode == Active {
+		go s.sequencePending()
+	}
+}
+
+// demote switches this replica to backup, stops checkpointing and drops the backup channels
+func (s *server) demote() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ServerRole == Backup {
+		log.Printf("[SERVER][%s] DEMOTE received but already backup", s.ReplicaId)
+		return
+	}
+	s.ServerRole = Backup
+	if s.stopPrimary != nil {
+		close(s.stopPrimary)
+		s.stopPrimary = nil
+	}
+	for bid, c := range s.BackupConns {
+		if c != nil {
+			_ = c.Close()
 		}
+		delete(s.BackupConns, bid)
+	}
+	s.acks = make(map[string]backupAck)
+	s.outgoing = nil
+	s.progress = make(map[string]chunkProgress)
+	// Accept the new primary's checkpoint numbering from scratch
+	s.CheckpointNo = 0
+	log.Printf("[SERVER][%s] demoted to BACKUP", s.ReplicaId)
+}
+
+// startPrimaryLoopLocked starts the primary's background loop if it is not running:
+// checkpoints as the policy demands in passive mode, peer (re)dialing for order
+// delivery in both modes
+// Caller must hold s.mu
+func (s *server) startPrimaryLoopLocked() {
+	if s.stopPrimary != nil {
+		return
+	}
+	if s.ServerMode == Passive && s.CheckpointFreq <= 0 && s.CheckpointReqs <= 0 {
+		return
 	}
+	s.lastCkptAt = time.Now()
+	s.appliedSinceCkpt = 0
+	stop := make(chan struct{})
+	s.stopPrimary = stop
+	go func() {
+		s.dialBackups()
+		freq := peerRedialFreq
+		if s.ServerMode == Passive {
+			freq = checkpointPollFreq
+		}
+		t := time.NewTicker(freq)
+		defer t.Stop()
+		lastDial := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if time.Since(lastDial) >= peerRedialFreq {
+					s.dialBackups()
+					lastDial = time.Now()
+				}
+				if s.ServerMode == Passive && s.checkpointDue() {
+					s.dialBackups()
+					s.sendCheckpoint()
+				}
+			}
+		}
+	}()
 }
 
 func (s *server) dialBackups() {
-	if s.ServerRole != Primary {
+	if !s.isPrimary() {
 		return
 	}
 	type target struct {
@@ -231,40 +592,77 @@ func (s *server) dialBackups() {
 	var todo []target
 	s.mu.Lock()
 	for bid, baddr := range s.Backups {
+		if bid == s.ReplicaId {
+			continue
+		}
 		if _, ok := s.BackupConns[bid]; !ok {
 			todo = append(todo, target{id: bid, addr: baddr})
 		}
 	}
 	s.mu.Unlock()
 	for _, t := range todo {
-		conn, err := net.Dial("tcp", t.addr)
-		if err != nil {
-			log.Printf("[SERVER][%s] dial backup %s@%s failed: %v", s.ReplicaId, t.id, t.addr, err)
-			continue
-		}
-		s.mu.Lock()
-		if old, ok := s.BackupConns[t.id]; ok && old != nil {
+		s.dialBackup(t.id, t.addr, false)
+	}
+}
+
+// dialBackup opens the secondary channel to one backup. With replace set, an
+// existing channel is closed first (the backup restarted and it is stale).
+func (s *server) dialBackup(bid, baddr string, replace bool) bool {
+	conn, err := utils.Dial(baddr, 0)
+	if err != nil {
+		log.Printf("[SERVER][%s] dial backup %s@%s failed: %v", s.ReplicaId, bid, baddr, err)
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.BackupConns[bid]; ok && old != nil {
+		if !replace {
 			_ = conn.Close()
-		} else {
-			s.BackupConns[t.id] = conn
-			log.Printf("[SERVER][%s] secondary channel established to backup %s@%s",
-				s.ReplicaId, t.id, t.addr)
+			return true
 		}
-		s.mu.Unlock()
+		_ = old.Close()
+		// The backup restarted; its earlier acks no longer describe its state
+		delete(s.acks, bid)
+		delete(s.progress, bid)
 	}
+	s.attachBackupLocked(bid, conn)
+	log.Printf("[SERVER][%s] secondary channel established to backup %s@%s",
+		s.ReplicaId, bid, baddr)
+	return true
+}
+
+// attachBackupLocked makes conn the secondary channel to a backup and
+// continues a chunked checkpoint the previous channel left unfinished
+// Caller must hold s.mu
+func (s *server) attachBackupLocked(bid string, conn net.Conn) {
+	s.BackupConns[bid] = conn
+	go s.readAcks(bid, conn)
+	go s.resumeTransfer(bid, conn)
 }
 
-func (s *server) sendCheckpoint() {
+// sendCheckpoint takes the next checkpoint and sends it to every connected
+// backup. It returns the checkpoint number and the backups it was sent to;
+// the number is 0 if no checkpoint was taken.
+func (s *server) sendCheckpoint() (int, []string) {
+	s.ckptMu.Lock()
+	defer s.ckptMu.Unlock()
+
+	s.mu.Lock()
 	if s.ServerRole != Primary {
-		return
+		s.mu.Unlock()
+		return 0, nil
 	}
-	s.mu.Lock()
-	ckpt := CheckpointMessage{
-		Type:          Checkpoint,
-		ReplicaId:     s.ReplicaId,
-		ServerState:   s.ServerState,
-		CheckpointNum: s.CheckpointNo + 1,
+	s.logBackupLagLocked()
+	s.adaptCheckpointFreqLocked()
+	s.lastCkptAt = time.Now()
+	s.appliedSinceCkpt = 0
+	ckpt, err := s.nextCheckpointLocked()
+	if err != nil {
+		s.mu.Unlock()
+		log.Printf("[SERVER][%s] snapshot failed, skip checkpoint: %v", s.ReplicaId, err)
+		return 0, nil
 	}
+	durable, persist := s.durableCheckpointLocked(ckpt)
 	s.CheckpointNo++
 	conns := make(map[string]net.Conn, len(s.BackupConns))
 	for id, c := range s.BackupConns {
@@ -272,18 +670,36 @@ func (s *server) sendCheckpoint() {
 	}
 	s.mu.Unlock()
 
-	payload, err := json.Marshal(ckpt)
+	if persist {
+		s.persistCheckpoint(durable)
+	}
+
+	line, err := encodeCheckpoint(ckpt)
 	if err != nil {
 		log.Printf("[SERVER][%s] marshal checkpoint failed: %v", s.ReplicaId, err)
-		return
+		return 0, nil
+	}
+	payload := []byte(line)
+	var out *outgoingCheckpoint
+	if len(payload) > checkpointChunkSize {
+		out = &outgoingCheckpoint{num: ckpt.CheckpointNum, payload: payload, checksum: crc32.ChecksumIEEE(payload)}
 	}
-	line := string(payload)
+	// An older unfinished transfer is not worth resuming anymore
+	s.mu.Lock()
+	s.outgoing = out
+	s.mu.Unlock()
 
+	var sent []string
 	for bid, c := range conns {
 		if c == nil {
 			continue
 		}
-		if err := utils.WriteLine(c, line); err != nil {
+		if out != nil {
+			err = s.sendChunked(bid, c, out)
+		} else {
+			err = utils.WriteLine(c, line)
+		}
+		if err != nil {
 			log.Printf("[SERVER][%s] send checkpoint to %s failed: %v (will drop conn)", s.ReplicaId, bid, err)
 			s.mu.Lock()
 			if old, ok := s.BackupConns[bid]; ok {
@@ -292,26 +708,23 @@ func (s *server) sendCheckpoint() {
 			}
 			s.mu.Unlock()
 		} else {
-			log.Printf("[SERVER][%s] checkpoint #%d sent to %s (server_state=%d)",
-				s.ReplicaId, ckpt.CheckpointNum, bid, ckpt.ServerState)
+			log.Printf("[SERVER][%s] checkpoint #%d (%s) sent to %s (state=%d bytes, last_seq=%d)",
+				s.ReplicaId, ckpt.CheckpointNum, describeCheckpoint(ckpt), bid, len(ckpt.State), ckpt.LastSeq)
+			sent = append(sent, bid)
 		}
 	}
+	return ckpt.CheckpointNum, sent
 }
 
 func (s *server) Run() error {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	if s.ServerRole == Primary && s.CheckpointFreq > 0 {
-		go func() {
-			t := time.NewTicker(s.CheckpointFreq)
-			defer t.Stop()
-			for range t.C {
-				s.dialBackups()
-				s.sendCheckpoint()
-			}
-		}()
-	}
 	listener := utils.MustListen(s.Addr)
 	log.Printf("[SERVER][%s] listening on %s", s.ReplicaId, s.Addr)
+	// Serve peers and LFD while recovering; client requests wait for readiness
+	go s.recoverState()
+	if s.store != nil && s.ServerMode == Active && s.CheckpointFreq > 0 {
+		go s.persistLoop()
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
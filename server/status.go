@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wenyinh/18749-project/utils"
+)
+
+// CheckpointAckMessage is sent by a passive backup on the secondary channel
+// once it holds the state of a checkpoint
+type CheckpointAckMessage struct {
+	Type          string `json:"type"`
+	ReplicaId     string `json:"replica_id"`
+	CheckpointNum int    `json:"checkpoint_num"`
+	LastSeq       int    `json:"last_seq"`
+}
+
+// BackupStatus is the primary's view of one backup
+type BackupStatus struct {
+	Connected       bool      `json:"connected"`
+	AckedCheckpoint int       `json:"acked_checkpoint"`
+	AckedSeq        int       `json:"acked_seq"`
+	CheckpointLag   int       `json:"checkpoint_lag"` // Checkpoints taken since the last one acked
+	LastAck         time.Time `json:"last_ack"`
+	// SafeToPromote is set for connected backups that acked the latest checkpoint
+	SafeToPromote bool `json:"safe_to_promote"`
+}
+
+// StatusMessage answers a STATUS query
+type StatusMessage struct {
+	Type         string                  `json:"type"`
+	ReplicaId    string                  `json:"replica_id"`
+	Role         string                  `json:"role"`
+	Mode         string                  `json:"mode"`
+	Ready        bool                    `json:"ready"`
+	CheckpointNo int                     `json:"checkpoint_no"`
+	LastSeq      int                     `json:"last_seq"`
+	Policy       PolicyStatus            `json:"policy"`
+	Backups      map[string]BackupStatus `json:"backups,omitempty"` // Primary only
+}
+
+// PolicyStatus reports the checkpoint policy and the interval currently in effect
+type PolicyStatus struct {
+	IntervalMs          int64 `json:"interval_ms"`
+	Requests            int   `json:"requests"`
+	Adaptive            bool  `json:"adaptive"`
+	FullEvery           int   `json:"full_every"`
+	EffectiveIntervalMs int64 `json:"effective_interval_ms"`
+}
+
+// CheckpointNowMessage answers CHECKPOINT_NOW once the checkpoint is acked
+// by every backup it was sent to, or after CheckpointNowTimeout
+type CheckpointNowMessage struct {
+	Type          string   `json:"type"`
+	ReplicaId     string   `json:"replica_id"`
+	CheckpointNum int      `json:"checkpoint_num"`
+	Acked         []string `json:"acked"`
+	Missing       []string `json:"missing,omitempty"` // Sent to but not acked in time
+}
+
+// CheckpointNowTimeout bounds how long CHECKPOINT_NOW waits for backup acks
+const CheckpointNowTimeout = 5 * time.Second
+
+// backupAck is the latest checkpoint a backup acknowledged
+type backupAck struct {
+	CheckpointNum int
+	LastSeq       int
+	At            time.Time
+}
+
+// sendCheckpointAck tells the primary this backup holds the given checkpoint
+func (s *server) sendCheckpointAck(conn net.Conn, ckpt CheckpointMessage) {
+	payload, err := json.Marshal(CheckpointAckMessage{
+		Type:          CheckpointAck,
+		ReplicaId:     s.ReplicaId,
+		CheckpointNum: ckpt.CheckpointNum,
+		LastSeq:       ckpt.LastSeq,
+	})
+	if err != nil {
+		log.Printf("[SERVER][%s] marshal checkpoint ack failed: %v", s.ReplicaId, err)
+		return
+	}
+	if err := utils.WriteLine(conn, string(payload)); err != nil {
+		log.Printf("[SERVER][%s] send ack for checkpoint #%d to %s failed: %v",
+			s.ReplicaId, ckpt.CheckpointNum, ckpt.ReplicaId, err)
+	}
+}
+
+// readAcks reads checkpoint acks from one backup's secondary channel until it
+// closes, then drops the channel so the primary loop redials it
+func (s *server) readAcks(bid string, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := utils.ReadLine(r)
+		if err != nil {
+			s.mu.Lock()
+			if c, ok := s.BackupConns[bid]; ok && c == conn {
+				log.Printf("[SERVER][%s] secondary channel to %s closed: %v", s.ReplicaId, bid, err)
+				_ = c.Close()
+				delete(s.BackupConns, bid)
+			}
+			s.mu.Unlock()
+			return
+		}
+		var mt MessageType
+		if err := json.Unmarshal([]byte(line), &mt); err != nil {
+			log.Printf("[SERVER][%s] unexpected message from backup %s: %s", s.ReplicaId, bid, line)
+			continue
+		}
+		switch mt.Type {
+		case CheckpointAck:
+			var ack CheckpointAckMessage
+			if err := json.Unmarshal([]byte(line), &ack); err != nil {
+				log.Printf("[SERVER][%s] bad CHECKPOINT_ACK json from %s: %v", s.ReplicaId, bid, err)
+				continue
+			}
+			s.recordAck(bid, ack)
+		case FullCheckpointReq:
+			var req CheckpointAckMessage
+			if err := json.Unmarshal([]byte(line), &req); err != nil {
+				log.Printf("[SERVER][%s] bad FULL_CHECKPOINT_REQ json from %s: %v", s.ReplicaId, bid, err)
+				continue
+			}
+			s.mu.Lock()
+			s.needFull = true
+			s.mu.Unlock()
+			log.Printf("[SERVER][%s] %s is at checkpoint #%d and rejected a delta, next checkpoint is full",
+				s.ReplicaId, bid, req.CheckpointNum)
+		case CheckpointChunkAck:
+			var ack CheckpointChunkMessage
+			if err := json.Unmarshal([]byte(line), &ack); err != nil {
+				log.Printf("[SERVER][%s] bad CKPT_CHUNK_ACK json from %s: %v", s.ReplicaId, bid, err)
+				continue
+			}
+			s.recordChunkAck(bid, conn, ack)
+		default:
+			log.Printf("[SERVER][%s] unexpected message from backup %s: %s", s.ReplicaId, bid, line)
+		}
+	}
+}
+
+// recordAck notes the latest checkpoint a backup holds
+func (s *server) recordAck(bid string, ack CheckpointAckMessage) {
+	s.mu.Lock()
+	if prev, ok := s.acks[bid]; !ok || ack.CheckpointNum >= prev.CheckpointNum {
+		s.acks[bid] = backupAck{CheckpointNum: ack.CheckpointNum, LastSeq: ack.LastSeq, At: time.Now()}
+	}
+	lag := s.CheckpointNo - ack.CheckpointNum
+	s.mu.Unlock()
+	log.Printf("[SERVER][%s] %s acked checkpoint #%d (last_seq=%d, lag=%d)",
+		s.ReplicaId, bid, ack.CheckpointNum, ack.LastSeq, lag)
+}
+
+// backupStatusLocked reports every configured backup as seen by the primary
+// Caller must hold s.mu
+func (s *server) backupStatusLocked() map[string]BackupStatus {
+	out := make(map[string]BackupStatus, len(s.Backups))
+	for bid := range s.Backups {
+		if bid == s.ReplicaId {
+			continue
+		}
+		_, connected := s.BackupConns[bid]
+		if s.ServerMode == Active {
+			// Active replicas apply every order themselves and exchange no checkpoints
+			out[bid] = BackupStatus{Connected: connected, SafeToPromote: connected}
+			continue
+		}
+		st := BackupStatus{Connected: connected, CheckpointLag: s.CheckpointNo}
+		if ack, ok := s.acks[bid]; ok {
+			st.AckedCheckpoint = ack.CheckpointNum
+			st.AckedSeq = ack.LastSeq
+			st.CheckpointLag = s.CheckpointNo - ack.CheckpointNum
+			st.LastAck = ack.At
+		}
+		st.SafeToPromote = connected && st.CheckpointLag == 0
+		out[bid] = st
+	}
+	return out
+}
+
+// logBackupLagLocked prints how far each backup is behind the latest checkpoint
+// Caller must hold s.mu
+func (s *server) logBackupLagLocked() {
+	status := s.backupStatusLocked()
+	if len(status) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(status))
+	for bid := range status {
+		ids = append(ids, bid)
+	}
+	sort.Strings(ids)
+	parts := make([]string, 0, len(ids))
+	for _, bid := range ids {
+		st := status[bid]
+		switch {
+		case !st.Connected:
+			parts = append(parts, fmt.Sprintf("%s=disconnected", bid))
+		case st.SafeToPromote:
+			parts = append(parts, fmt.Sprintf("%s=%d (safe)", bid, st.CheckpointLag))
+		default:
+			parts = append(parts, fmt.Sprintf("%s=%d", bid, st.CheckpointLag))
+		}
+	}
+	log.Printf("[SERVER][%s] backup lag at checkpoint #%d: %s", s.ReplicaId, s.CheckpointNo, strings.Join(parts, ", "))
+}
+
+// handleStatus answers a STATUS query with this replica's view of the group
+func (s *server) handleStatus(conn net.Conn) {
+	s.mu.Lock()
+	status := StatusMessage{
+		Type:         Status,
+		ReplicaId:    s.ReplicaId,
+		Role:         s.ServerRole.String(),
+		Mode:         s.ServerMode.String(),
+		Ready:        s.ready,
+		CheckpointNo: s.CheckpointNo,
+		LastSeq:      s.nextSeq - 1,
+		Policy: PolicyStatus{
+			IntervalMs:          s.CheckpointFreq.Milliseconds(),
+			Requests:            s.CheckpointReqs,
+			Adaptive:            s.Adaptive,
+			FullEvery:           s.FullEvery,
+			EffectiveIntervalMs: s.checkpointIntervalLocked().Milliseconds(),
+		},
+	}
+	if s.ServerRole == Primary {
+		status.Backups = s.backupStatusLocked()
+	}
+	s.mu.Unlock()
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("[SERVER][%s] marshal status failed: %v", s.ReplicaId, err)
+		_ = utils.WriteLine(conn, "ERROR: failed to create status")
+		return
+	}
+	_ = utils.WriteLine(conn, string(payload))
+}
+
+// handleCheckpointNow takes a checkpoint immediately and answers once every
+// reachable backup acked it
+func (s *server) handleCheckpointNow(conn net.Conn) {
+	s.mu.Lock()
+	isPrimary := s.ServerRole == Primary && s.ready
+	mode := s.ServerMode
+	s.mu.Unlock()
+	if !isPrimary {
+		_ = utils.WriteLine(conn, "ERROR: not a ready primary")
+		return
+	}
+	if mode == Active {
+		_ = utils.WriteLine(conn, "ERROR: active mode exchanges no checkpoints")
+		return
+	}
+
+	log.Printf("[SERVER][%s] checkpoint requested by %s", s.ReplicaId, conn.RemoteAddr())
+	s.dialBackups()
+	num, sent := s.sendCheckpoint()
+	if num == 0 {
+		_ = utils.WriteLine(conn, "ERROR: checkpoint failed")
+		return
+	}
+
+	reply := CheckpointNowMessage{Type: CheckpointNow, ReplicaId: s.ReplicaId, CheckpointNum: num, Acked: []string{}}
+	deadline := time.Now().Add(CheckpointNowTimeout)
+	for {
+		reply.Acked, reply.Missing = s.ackedThrough(num, sent)
+		if len(reply.Missing) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(reply.Missing) > 0 {
+		log.Printf("[SERVER][%s] checkpoint #%d not acked by %s within %v",
+			s.ReplicaId, num, strings.Join(reply.Missing, ", "), CheckpointNowTimeout)
+	}
+
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("[SERVER][%s] marshal checkpoint reply failed: %v", s.ReplicaId, err)
+		_ = utils.WriteLine(conn, "ERROR: failed to create reply")
+		return
+	}
+	_ = utils.WriteLine(conn, string(payload))
+}
+
+// ackedThrough splits backups by whether they acked checkpoint num or later
+func (s *server) ackedThrough(num int, backups []string) ([]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acked := make([]string, 0, len(backups))
+	var missing []string
+	for _, bid := range backups {
+		if ack, ok := s.acks[bid]; ok && ack.CheckpointNum >= num {
+			acked = append(acked, bid)
+		} else {
+			missing = append(missing, bid)
+		}
+	}
+	sort.Strings(acked)
+	sort.Strings(missing)
+	return acked, missing
+}
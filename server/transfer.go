@@ -0,0 +1,338 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"time"
+
+	"github.com/wenyinh/18749-project/utils"
+)
+
+const (
+	// checkpointChunkSize is the largest checkpoint sent as a single line; bigger
+	// ones are streamed as CKPT_BEGIN, CKPT_CHUNK... and CKPT_END
+	checkpointChunkSize = 64 * 1024
+	// checkpointWindow is how many bytes the primary sends past the backup's last ack
+	checkpointWindow = 4 * checkpointChunkSize
+	// chunkAckTimeout is how long the primary waits for the backup to acknowledge progress
+	chunkAckTimeout = 5 * time.Second
+)
+
+// CheckpointChunkMessage carries one step of a chunked checkpoint transfer:
+//
+//	CKPT_BEGIN      total size and CRC32 of the serialized checkpoint
+//	CKPT_CHUNK      data at offset with its own length and CRC32
+//	CKPT_END        the transfer is complete
+//	CKPT_CHUNK_ACK  backup -> primary, offset is the next byte it expects
+type CheckpointChunkMessage struct {
+	Type          string `json:"type"`
+	ReplicaId     string `json:"replica_id"`
+	CheckpointNum int    `json:"checkpoint_num"`
+	Offset        int    `json:"offset"`
+	Length        int    `json:"length,omitempty"`
+	Total         int    `json:"total,omitempty"`
+	Checksum      uint32 `json:"checksum,omitempty"`
+	Data          []byte `json:"data,omitempty"`
+}
+
+// outgoingCheckpoint is the latest chunked checkpoint the primary sent, kept
+// so an interrupted transfer can resume on the backup's next channel
+type outgoingCheckpoint struct {
+	num      int
+	payload  []byte
+	checksum uint32
+}
+
+// chunkProgress is how far one backup got in the latest chunked transfer
+type chunkProgress struct {
+	num   int
+	acked int      // Next byte the backup expects
+	conn  net.Conn // Channel the transfer was sent on
+	// acks receives the backup's CKPT_CHUNK_ACKs while the transfer runs; nil otherwise
+	acks chan CheckpointChunkMessage
+}
+
+// incomingCheckpoint is a backup's partially received chunked checkpoint. It
+// outlives the channel, so a transfer restarted with the same checkpoint
+// number and checksum continues where it stopped.
+type incomingCheckpoint struct {
+	from     string
+	num      int
+	total    int
+	checksum uint32
+	data     []byte
+}
+
+// sendChunked streams a serialized checkpoint to one backup on its secondary
+// channel, from wherever the backup's partial copy of it ends
+func (s *server) sendChunked(bid string, conn net.Conn, out *outgoingCheckpoint) error {
+	acks := make(chan CheckpointChunkMessage, 2*checkpointWindow/checkpointChunkSize)
+	s.mu.Lock()
+	p := s.progress[bid]
+	if p.num != out.num {
+		p = chunkProgress{num: out.num}
+	}
+	p.conn = conn
+	p.acks = acks
+	s.progress[bid] = p
+	s.mu.Unlock()
+
+	err := s.streamChunks(conn, out, acks)
+
+	s.mu.Lock()
+	if p, ok := s.progress[bid]; ok && p.acks == acks {
+		p.acks = nil
+		s.progress[bid] = p
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// streamChunks sends CKPT_BEGIN and then the chunks from the offset the
+// receiver answers with, keeping at most checkpointWindow bytes unacknowledged.
+// A repeated ack means the receiver dropped the chunk at that offset, so
+// sending rewinds to it. CKPT_END follows once every byte is acknowledged.
+func (s *server) streamChunks(conn net.Conn, out *outgoingCheckpoint, acks <-chan CheckpointChunkMessage) error {
+	total := len(out.payload)
+	begin := CheckpointChunkMessage{
+		Type:          CheckpointBegin,
+		ReplicaId:     s.ReplicaId,
+		CheckpointNum: out.num,
+		Total:         total,
+		Checksum:      out.checksum,
+	}
+	if err := s.writeChunkMessage(conn, begin); err != nil {
+		return err
+	}
+
+	acked, next, rewound := -1, 0, -1
+	for acked < total {
+		if acked >= 0 && next < total && next < acked+checkpointWindow {
+			end := next + checkpointChunkSize
+			if end > total {
+				end = total
+			}
+			data := out.payload[next:end]
+			chunk := CheckpointChunkMessage{
+				Type:          CheckpointChunk,
+				ReplicaId:     s.ReplicaId,
+				CheckpointNum: out.num,
+				Offset:        next,
+				Length:        len(data),
+				Checksum:      crc32.ChecksumIEEE(data),
+				Data:          data,
+			}
+			if err := s.writeChunkMessage(conn, chunk); err != nil {
+				return err
+			}
+			next = end
+			continue
+		}
+
+		select {
+		case ack, ok := <-acks:
+			if !ok {
+				return fmt.Errorf("channel closed at offset %d/%d", acked, total)
+			}
+			if ack.CheckpointNum != out.num || ack.Offset < 0 || ack.Offset > total {
+				continue
+			}
+			switch {
+			case acked < 0:
+				// The answer to CKPT_BEGIN: how much the receiver already holds
+				acked, next = ack.Offset, ack.Offset
+				if acked > 0 {
+					log.Printf("[SERVER][%s] checkpoint #%d continues at offset %d/%d",
+						s.ReplicaId, out.num, acked, total)
+				}
+			case ack.Offset > acked:
+				acked = ack.Offset
+				if next < acked {
+					next = acked
+				}
+			case ack.Offset == acked && next > acked && rewound != acked:
+				log.Printf("[SERVER][%s] checkpoint #%d chunk at %d was not accepted, resending from there",
+					s.ReplicaId, out.num, acked)
+				rewound, next = acked, acked
+			}
+		case <-time.After(chunkAckTimeout):
+			return fmt.Errorf("no chunk ack within %v at offset %d/%d", chunkAckTimeout, acked, total)
+		}
+	}
+	return s.writeChunkMessage(conn, CheckpointChunkMessage{
+		Type:          CheckpointEnd,
+		ReplicaId:     s.ReplicaId,
+		CheckpointNum: out.num,
+		Offset:        total,
+		Total:         total,
+		Checksum:      out.checksum,
+	})
+}
+
+func (s *server) writeChunkMessage(conn net.Conn, msg CheckpointChunkMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return utils.WriteLine(conn, string(payload))
+}
+
+// resumeTransfer finishes the latest chunked checkpoint on a backup's new
+// channel if its previous channel broke off during the transfer
+func (s *server) resumeTransfer(bid string, conn net.Conn) {
+	s.ckptMu.Lock()
+	defer s.ckptMu.Unlock()
+
+	s.mu.Lock()
+	out := s.outgoing
+	p, ok := s.progress[bid]
+	current := s.BackupConns[bid] == conn
+	s.mu.Unlock()
+	if out == nil || !ok || p.num != out.num || p.acked >= len(out.payload) || !current {
+		return
+	}
+
+	log.Printf("[SERVER][%s] resuming checkpoint #%d to %s (acked %d/%d bytes)",
+		s.ReplicaId, out.num, bid, p.acked, len(out.payload))
+	if err := s.sendChunked(bid, conn, out); err != nil {
+		log.Printf("[SERVER][%s] resume checkpoint #%d to %s failed: %v (will drop conn)",
+			s.ReplicaId, out.num, bid, err)
+		s.mu.Lock()
+		if old, ok := s.BackupConns[bid]; ok && old == conn {
+			_ = old.Close()
+			delete(s.BackupConns, bid)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// recordChunkAck notes how much of a chunked checkpoint a backup holds and
+// passes the ack on to the transfer running on that channel
+func (s *server) recordChunkAck(bid string, conn net.Conn, ack CheckpointChunkMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.progress[bid]
+	if !ok || p.num != ack.CheckpointNum {
+		return
+	}
+	if ack.Offset > p.acked {
+		p.acked = ack.Offset
+		s.progress[bid] = p
+	}
+	if p.acks != nil && p.conn == conn {
+		select {
+		case p.acks <- ack:
+		default:
+			// Later acks carry the same information
+		}
+	}
+}
+
+// handleCheckpointTransfer assembles a chunked checkpoint on a backup and
+// hands the complete checkpoint to handleCheckpoint
+func (s *server) handleCheckpointTransfer(conn net.Conn, msg CheckpointChunkMessage) {
+	s.mu.Lock()
+	in := s.incoming
+	switch msg.Type {
+	case CheckpointBegin:
+		if in != nil && in.from == msg.ReplicaId && in.num == msg.CheckpointNum &&
+			in.total == msg.Total && in.checksum == msg.Checksum {
+			log.Printf("[SERVER][%s] resuming checkpoint #%d from %s at %d/%d bytes",
+				s.ReplicaId, msg.CheckpointNum, msg.ReplicaId, len(in.data), in.total)
+		} else {
+			in = &incomingCheckpoint{
+				from:     msg.ReplicaId,
+				num:      msg.CheckpointNum,
+				total:    msg.Total,
+				checksum: msg.Checksum,
+				data:     make([]byte, 0, msg.Total),
+			}
+			s.incoming = in
+			log.Printf("[SERVER][%s] receiving checkpoint #%d from %s in chunks (%d bytes)",
+				s.ReplicaId, msg.CheckpointNum, msg.ReplicaId, msg.Total)
+		}
+		offset := len(in.data)
+		s.mu.Unlock()
+		s.sendChunkAck(conn, msg.CheckpointNum, offset)
+
+	case CheckpointChunk:
+		if in == nil || in.from != msg.ReplicaId || in.num != msg.CheckpointNum {
+			s.mu.Unlock()
+			log.Printf("[SERVER][%s] drop chunk of checkpoint #%d from %s: no such transfer",
+				s.ReplicaId, msg.CheckpointNum, msg.ReplicaId)
+			return
+		}
+		err := in.add(msg)
+		offset := len(in.data)
+		if err != nil {
+			// Re-acking what we hold makes the primary resend from there
+			log.Printf("[SERVER][%s] drop chunk of checkpoint #%d: %v, have %d bytes",
+				s.ReplicaId, msg.CheckpointNum, err, offset)
+		}
+		s.mu.Unlock()
+		s.sendChunkAck(conn, msg.CheckpointNum, offset)
+
+	case CheckpointEnd:
+		if in == nil || in.from != msg.ReplicaId || in.num != msg.CheckpointNum {
+			s.mu.Unlock()
+			return
+		}
+		if len(in.data) != in.total {
+			s.mu.Unlock()
+			log.Printf("[SERVER][%s] checkpoint #%d from %s incomplete at end: %d/%d bytes",
+				s.ReplicaId, msg.CheckpointNum, msg.ReplicaId, len(in.data), in.total)
+			return
+		}
+		s.incoming = nil
+		s.mu.Unlock()
+
+		ckpt, err := decodeChunked(in)
+		if err != nil {
+			log.Printf("[SERVER][%s] discard checkpoint #%d from %s: %v",
+				s.ReplicaId, msg.CheckpointNum, msg.ReplicaId, err)
+			return
+		}
+		s.handleCheckpoint(conn, ckpt)
+
+	default:
+		s.mu.Unlock()
+	}
+}
+
+// add appends a chunk that continues the data received so far. Bytes already
+// held (resent after a rewind or reconnect) are skipped.
+func (in *incomingCheckpoint) add(msg CheckpointChunkMessage) error {
+	if len(msg.Data) != msg.Length || crc32.ChecksumIEEE(msg.Data) != msg.Checksum {
+		return fmt.Errorf("corrupt chunk at offset %d", msg.Offset)
+	}
+	have := len(in.data)
+	if msg.Offset < 0 || msg.Offset > have {
+		return fmt.Errorf("chunk at offset %d leaves a gap", msg.Offset)
+	}
+	if end := msg.Offset + len(msg.Data); end > have && end <= in.total {
+		in.data = append(in.data, msg.Data[have-msg.Offset:]...)
+	}
+	return nil
+}
+
+func decodeChunked(in *incomingCheckpoint) (CheckpointMessage, error) {
+	if crc32.ChecksumIEEE(in.data) != in.checksum {
+		return CheckpointMessage{}, fmt.Errorf("checksum mismatch")
+	}
+	return decodeCheckpoint(string(in.data))
+}
+
+func (s *server) sendChunkAck(conn net.Conn, num, offset int) {
+	err := s.writeChunkMessage(conn, CheckpointChunkMessage{
+		Type:          CheckpointChunkAck,
+		ReplicaId:     s.ReplicaId,
+		CheckpointNum: num,
+		Offset:        offset,
+	})
+	if err != nil {
+		log.Printf("[SERVER][%s] send chunk ack for checkpoint #%d failed: %v", s.ReplicaId, num, err)
+	}
+}
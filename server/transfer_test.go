@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wenyinh/18749-project/utils"
+)
+
+// limitConn records what is written and breaks the connection once more than
+// limit bytes would be written (limit < 0: never)
+type limitConn struct {
+	net.Conn
+	mu      sync.Mutex
+	limit   int
+	written int
+	data    []byte
+}
+
+func (c *limitConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limit >= 0 && c.written+len(p) > c.limit {
+		n, _ := c.Conn.Write(p[:c.limit-c.written])
+		c.written += n
+		c.data = append(c.data, p[:n]...)
+		_ = c.Conn.Close()
+		return n, errors.New("connection cut")
+	}
+	n, err := c.Conn.Write(p)
+	c.written += n
+	c.data = append(c.data, p[:n]...)
+	return n, err
+}
+
+// chunkOffsets returns the offsets of the CKPT_CHUNKs written so far
+func (c *limitConn) chunkOffsets() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var offsets []int
+	for _, line := range strings.Split(string(c.data), "\n") {
+		var msg CheckpointChunkMessage
+		if json.Unmarshal([]byte(line), &msg) == nil && msg.Type == CheckpointChunk {
+			offsets = append(offsets, msg.Offset)
+		}
+	}
+	return offsets
+}
+
+// bigKVStore returns a kv store whose checkpoint takes many chunks
+func bigKVStore() StateMachine {
+	kv := NewKVStore()
+	value := strings.Repeat("v", 256)
+	for i := 0; i < 2000; i++ {
+		kv.Apply(fmt.Sprintf("PUT key%04d %s", i, value))
+	}
+	return kv
+}
+
+// connectBackup opens a secondary channel from primary to backup over a pipe
+func connectBackup(primary, backup *server, limit int) *limitConn {
+	a, b := net.Pipe()
+	go backup.handleConnection(b)
+	c := &limitConn{Conn: a, limit: limit}
+	primary.mu.Lock()
+	primary.attachBackupLocked(backup.ReplicaId, c)
+	primary.mu.Unlock()
+	return c
+}
+
+func TestChunkedCheckpointResumes(t *testing.T) {
+	policy := CheckpointPolicy{Interval: time.Minute}
+	s1 := NewServer("", "S1", bigKVStore(), Primary, Passive, nil, nil, policy, "", FsyncBatch).(*server)
+	s2 := NewServer("", "S2", NewKVStore(), Backup, Passive, nil, nil, policy, "", FsyncBatch).(*server)
+	s2.mu.Lock()
+	s2.markReadyLocked()
+	s2.mu.Unlock()
+
+	// The channel breaks partway through the transfer
+	connectBackup(s1, s2, 3*checkpointChunkSize)
+	num, sent := s1.sendCheckpoint()
+	if num == 0 || len(sent) != 0 {
+		t.Fatalf("sendCheckpoint = #%d to %v, want a checkpoint that reached nobody", num, sent)
+	}
+	s1.mu.Lock()
+	total := len(s1.outgoing.payload)
+	acked := s1.progress["S2"].acked
+	s1.mu.Unlock()
+	if total <= 4*checkpointChunkSize {
+		t.Fatalf("checkpoint is %d bytes, too small to test chunking", total)
+	}
+	if acked <= 0 || acked >= total {
+		t.Fatalf("backup acked %d/%d bytes before the cut, want part of it", acked, total)
+	}
+	waitFor(t, 5*time.Second, "S2 to drop the broken channel", func() bool {
+		s2.mu.Lock()
+		defer s2.mu.Unlock()
+		return s2.incoming != nil && len(s2.incoming.data) == acked
+	})
+
+	// The redialed channel continues where the backup stopped
+	resumed := connectBackup(s1, s2, -1)
+	waitFor(t, 10*time.Second, "S2 to install the checkpoint", func() bool {
+		s2.mu.Lock()
+		defer s2.mu.Unlock()
+		return s2.CheckpointNo == num
+	})
+	if offsets := resumed.chunkOffsets(); len(offsets) == 0 || offsets[0] != acked {
+		t.Errorf("resumed transfer sent chunks at %v, want them to start at %d", offsets, acked)
+	}
+	s2.mu.Lock()
+	defer s2.mu.Unlock()
+	if got := s2.App.Apply("GET key1999"); got != strings.Repeat("v", 256) {
+		t.Errorf("GET key1999 on S2 = %q", got)
+	}
+	if s2.incoming != nil {
+		t.Error("S2 still holds a partial transfer")
+	}
+}
+
+func TestStreamChunksRewinds(t *testing.T) {
+	payload := []byte(strings.Repeat("0123456789abcdef", 5*checkpointChunkSize/16+7))
+	out := &outgoingCheckpoint{num: 7, payload: payload, checksum: crc32.ChecksumIEEE(payload)}
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+
+	// The receiver loses the second chunk once and re-acks what it holds
+	acks := make(chan CheckpointChunkMessage, 16)
+	received := make(chan []byte, 1)
+	go func() {
+		r := bufio.NewReader(b)
+		var in *incomingCheckpoint
+		dropped := false
+		for {
+			line, err := utils.ReadLine(r)
+			if err != nil {
+				return
+			}
+			var msg CheckpointChunkMessage
+			if err := json.Unmarshal([]byte(line), &msg); err != nil {
+				return
+			}
+			switch msg.Type {
+			case CheckpointBegin:
+				in = &incomingCheckpoint{num: msg.CheckpointNum, total: msg.Total, checksum: msg.Checksum}
+			case CheckpointChunk:
+				if msg.Offset == checkpointChunkSize && !dropped {
+					dropped = true
+					msg.Checksum++
+				}
+				_ = in.add(msg)
+			case CheckpointEnd:
+				received <- in.data
+				return
+			}
+			acks <- CheckpointChunkMessage{Type: CheckpointChunkAck, CheckpointNum: msg.CheckpointNum, Offset: len(in.data)}
+		}
+	}()
+
+	s := &server{ReplicaId: "S1"}
+	if err := s.streamChunks(a, out, acks); err != nil {
+		t.Fatalf("streamChunks: %v", err)
+	}
+	select {
+	case data := <-received:
+		if string(data) != string(payload) {
+			t.Errorf("received %d bytes, want the %d byte payload", len(data), len(payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver did not see CKPT_END")
+	}
+}
+
+func TestRecoveryCheckpointIsChunked(t *testing.T) {
+	policy := CheckpointPolicy{Interval: time.Minute}
+	s1 := NewServer("", "S1", bigKVStore(), Primary, Passive, nil, nil, policy, "", FsyncBatch).(*server)
+	s1.mu.Lock()
+	s1.ready = true
+	s1.mu.Unlock()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	accepted := make(chan *limitConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &limitConn{Conn: conn, limit: -1}
+		accepted <- c
+		s1.handleConnection(c)
+	}()
+
+	s2 := NewServer("", "S2", NewKVStore(), Backup, Passive, nil, nil, policy, "", FsyncBatch).(*server)
+	ckpt, err := s2.requestState("S1", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("requestState: %v", err)
+	}
+	if offsets := (<-accepted).chunkOffsets(); len(offsets) < 2 {
+		t.Errorf("recovery checkpoint went out in %d chunks, want it streamed", len(offsets))
+	}
+	app := NewKVStore()
+	if err := app.Restore(ckpt.State); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got := app.Apply("GET key1999"); got != strings.Repeat("v", 256) {
+		t.Errorf("GET key1999 after recovery = %q", got)
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	walFile = "wal"
+	// walBatchInterval is how often the batch fsync policy flushes the WAL
+	walBatchInterval = 10 * time.Millisecond
+)
+
+// FsyncPolicy controls when WAL appends are forced to disk
+type FsyncPolicy int
+
+const (
+	FsyncAlways FsyncPolicy = iota // fsync every append before the client is answered
+	FsyncBatch                     // fsync at most every walBatchInterval
+	FsyncNever                     // leave flushing to the OS
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncBatch:
+		return "batch"
+	default:
+		return "never"
+	}
+}
+
+// walRecord is one ordered request as written to the WAL
+type walRecord struct {
+	Seq     int            `json:"seq"`
+	Request RequestMessage `json:"request"`
+}
+
+// writeAheadLog records every request a replica applies since its last
+// persisted checkpoint. Each line is a CRC32 (hex), a space and the JSON
+// record; a torn or corrupt tail is cut off when the log is opened. The log
+// only shrinks when a checkpoint is persisted, so it needs a checkpoint policy
+// that TruncatesWAL.
+type writeAheadLog struct {
+	path   string
+	policy FsyncPolicy
+	f      *os.File
+	dirty  bool // Appended since the last fsync (batch policy)
+	mu     sync.Mutex
+}
+
+// openWAL opens the WAL in dir and returns it with the intact records it holds
+func openWAL(dir string, policy FsyncPolicy) (*writeAheadLog, []walRecord, error) {
+	path := filepath.Join(dir, walFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, good, err := readWAL(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	if err := f.Truncate(good); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	w := &writeAheadLog{path: path, policy: policy, f: f}
+	if policy == FsyncBatch {
+		go w.syncLoop()
+	}
+	return w, records, nil
+}
+
+// readWAL returns the records up to the first torn or corrupt line and the
+// file offset where they end
+func readWAL(r io.Reader) ([]walRecord, int64, error) {
+	var records []walRecord
+	var good int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line was never fully written
+			return records, good, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		rec, ok := decodeWALRecord(bytes.TrimSuffix(line, []byte("\n")))
+		if !ok {
+			return records, good, nil
+		}
+		records = append(records, rec)
+		good += int64(len(line))
+	}
+}
+
+func decodeWALRecord(line []byte) (walRecord, bool) {
+	var rec walRecord
+	header, payload, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return rec, false
+	}
+	sum, err := strconv.ParseUint(string(header), 16, 32)
+	if err != nil || crc32.ChecksumIEEE(payload) != uint32(sum) {
+		return rec, false
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, false
+	}
+	return rec, true
+}
+
+func encodeWALRecord(rec walRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%08x ", crc32.ChecksumIEEE(payload))
+	buf.Write(payload)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// Append writes one record; with FsyncAlways it is on disk when Append returns
+func (w *writeAheadLog) Append(rec walRecord) error {
+	line, err := encodeWALRecord(rec)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.f.Write(line); err != nil {
+		return err
+	}
+	switch w.policy {
+	case FsyncAlways:
+		return w.f.Sync()
+	case FsyncBatch:
+		w.dirty = true
+	}
+	return nil
+}
+
+func (w *writeAheadLog) syncLoop() {
+	t := time.NewTicker(walBatchInterval)
+	defer t.Stop()
+	for range t.C {
+		w.mu.Lock()
+		if w.dirty {
+			if err := w.f.Sync(); err != nil {
+				log.Printf("[WAL] fsync %s failed: %v", w.path, err)
+			}
+			w.dirty = false
+		}
+		w.mu.Unlock()
+	}
+}
+
+// TruncateThrough drops the records a persisted checkpoint covers (seq <= lastSeq)
+func (w *writeAheadLog) TruncateThrough(lastSeq int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	records, _, err := readWAL(f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	var keep []walRecord
+	for _, rec := range records {
+		if rec.Seq > lastSeq {
+			keep = append(keep, rec)
+		}
+	}
+	if len(keep) == len(records) {
+		return nil
+	}
+	return w.rewriteLocked(keep)
+}
+
+// Reset empties the log, e.g. after installing a checkpoint from the primary
+func (w *writeAheadLog) Reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	return w.rewriteLocked(nil)
+}
+
+// rewriteLocked atomically replaces the log with the given records
+// Caller must hold w.mu
+func (w *writeAheadLog) rewriteLocked(records []walRecord) error {
+	var buf bytes.Buffer
+	for _, rec := range records {
+		line, err := encodeWALRecord(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+	tmp := w.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := syncDir(filepath.Dir(w.path)); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		_ = f.Close()
+		return err
+	}
+	_ = w.f.Close()
+	w.f = f
+	w.dirty = false
+	return nil
+}
+
+// replayWAL re-applies the logged requests that follow the loaded checkpoint.
+// Called from NewServer before serving.
+func (s *server) replayWAL(records []walRecord) {
+	applied := 0
+	for _, rec := range records {
+		if rec.Seq < s.nextSeq {
+			continue
+		}
+		if rec.Seq != s.nextSeq {
+			log.Printf("[SERVER][%s] WAL gap at #%d (found #%d), ignoring the rest of the log",
+				s.ReplicaId, s.nextSeq, rec.Seq)
+			break
+		}
+		s.applyOnceLocked(rec.Request)
+		s.nextSeq++
+		applied++
+	}
+	log.Printf("[SERVER][%s] replayed %d WAL records, last_seq=%d", s.ReplicaId, applied, s.nextSeq-1)
+}
+
+// appendWALLocked logs an ordered request before it is applied and answered.
+// The request must not be applied if this fails.
+// Caller must hold s.mu
+func (s *server) appendWALLocked(seq int, req RequestMessage) error {
+	if s.wal == nil {
+		return nil
+	}
+	if err := s.wal.Append(walRecord{Seq: seq, Request: req}); err != nil {
+		return fmt.Errorf("WAL append of #%d: %w", seq, err)
+	}
+	return nil
+}
+
+// stopServingLocked takes a replica that can no longer log out of service. It
+// refuses clients and stops answering heartbeats, so the LFD reports it failed
+// and the RM moves the clients to a replica that can.
+// Caller must hold s.mu
+func (s *server) stopServingLocked(err error) {
+	if s.walErr != nil {
+		return
+	}
+	s.walErr = err
+	s.ready = false
+	if s.stopPrimary != nil {
+		close(s.stopPrimary)
+		s.stopPrimary = nil
+	}
+	red := "\033[31m"
+	reset := "\033[0m"
+	log.Printf("%s[SERVER][%s] %v, no longer serving%s", red, s.ReplicaId, err, reset)
+}
+
+func (s *server) resetWAL() {
+	if s.wal == nil {
+		return
+	}
+	if err := s.wal.Reset(); err != nil {
+		log.Printf("[SERVER][%s] WAL reset failed: %v", s.ReplicaId, err)
+	}
+}
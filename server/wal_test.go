@@ -0,0 +1,218 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func walRequest(seq int, command string) walRecord {
+	return walRecord{Seq: seq, Request: RequestMessage{Type: Req, ClientID: "C1", RequestNum: seq, Message: command}}
+}
+
+// writeTestWAL appends records to a fresh WAL in dir and closes it
+func writeTestWAL(t *testing.T, dir string, records ...walRecord) {
+	t.Helper()
+	w, _, err := openWAL(dir, FsyncAlways)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+	for _, rec := range records {
+		if err := w.Append(rec); err != nil {
+			t.Fatalf("Append #%d: %v", rec.Seq, err)
+		}
+	}
+	_ = w.f.Close()
+}
+
+func reopenTestWAL(t *testing.T, dir string) (*writeAheadLog, []walRecord) {
+	t.Helper()
+	w, records, err := openWAL(dir, FsyncAlways)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = w.f.Close()
+	})
+	return w, records
+}
+
+func seqs(records []walRecord) []int {
+	var out []int
+	for _, rec := range records {
+		out = append(out, rec.Seq)
+	}
+	return out
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir := t.TempDir()
+	writeTestWAL(t, dir, walRequest(1, "PUT a 1"), walRequest(2, "PUT b 2"))
+	path := filepath.Join(dir, walFile)
+	intact, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of the third append
+	line, err := encodeWALRecord(walRequest(3, "PUT c 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(line[:len(line)/2])
+	_ = f.Close()
+
+	w, records := reopenTestWAL(t, dir)
+	if got := seqs(records); !slices.Equal(got, []int{1, 2}) {
+		t.Fatalf("records after torn append = %v, want [1 2]", got)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != intact.Size() {
+		t.Errorf("WAL size = %d after reopen, want the torn tail cut to %d", info.Size(), intact.Size())
+	}
+
+	// New appends follow the intact records
+	if err := w.Append(walRequest(3, "PUT c 3")); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.f.Close()
+	_, records = reopenTestWAL(t, dir)
+	if got := seqs(records); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("records after re-append = %v, want [1 2 3]", got)
+	}
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(line []byte) []byte
+	}{
+		{"payload bit flip", func(line []byte) []byte {
+			line[len(line)-3] ^= 0x01
+			return line
+		}},
+		{"bad checksum", func(line []byte) []byte {
+			copy(line, "zzzzzzzz")
+			return line
+		}},
+		{"no separator", func(line []byte) []byte {
+			return []byte("0000000000\n")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var data []byte
+			for seq := 1; seq <= 3; seq++ {
+				line, err := encodeWALRecord(walRequest(seq, "PUT k v"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if seq == 2 {
+					line = tt.corrupt(line)
+				}
+				data = append(data, line...)
+			}
+			if err := os.WriteFile(filepath.Join(dir, walFile), data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			// Nothing after a corrupt record can be trusted to follow it in order
+			_, records := reopenTestWAL(t, dir)
+			if got := seqs(records); !slices.Equal(got, []int{1}) {
+				t.Errorf("records = %v, want [1]", got)
+			}
+		})
+	}
+}
+
+func TestWALTruncateThrough(t *testing.T) {
+	dir := t.TempDir()
+	writeTestWAL(t, dir, walRequest(1, "PUT a 1"), walRequest(2, "PUT b 2"), walRequest(3, "PUT c 3"))
+	w, _ := reopenTestWAL(t, dir)
+	if err := w.TruncateThrough(2); err != nil {
+		t.Fatalf("TruncateThrough: %v", err)
+	}
+	if err := w.Append(walRequest(4, "PUT d 4")); err != nil {
+		t.Fatal(err)
+	}
+	_, records := reopenTestWAL(t, dir)
+	if got := seqs(records); !slices.Equal(got, []int{3, 4}) {
+		t.Errorf("records after truncation = %v, want [3 4]", got)
+	}
+}
+
+func TestReplayWAL(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newCheckpointStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checkpoint covers #1, so #2 and #3 are replayed and #5 follows a gap
+	base := NewKVStore()
+	base.Apply("PUT a 1")
+	state, err := base.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(CheckpointMessage{Type: Checkpoint, ReplicaId: "S1", State: state, CheckpointNum: 1, LastSeq: 1}); err != nil {
+		t.Fatal(err)
+	}
+	writeTestWAL(t, dir,
+		walRequest(1, "PUT a 1"),
+		walRequest(2, "PUT b 2"),
+		walRequest(3, "PUT a 3"),
+		walRequest(5, "PUT c 5"),
+	)
+
+	app := NewKVStore()
+	s := NewServer(":0", "S1", app, Primary, Passive, nil, nil, CheckpointPolicy{Interval: time.Second}, dir, FsyncAlways).(*server)
+	t.Cleanup(func() {
+		_ = s.wal.f.Close()
+	})
+	if s.nextSeq != 4 {
+		t.Errorf("nextSeq = %d after replay, want 4", s.nextSeq)
+	}
+	for key, want := range map[string]string{"a": "3", "b": "2", "c": kvNotFound} {
+		if got := app.Apply("GET " + key); got != want {
+			t.Errorf("GET %s = %q after replay, want %q", key, got, want)
+		}
+	}
+}
+
+func TestWALAppendFailureStopsServing(t *testing.T) {
+	app := NewKVStore()
+	s := NewServer(":0", "S1", app, Primary, Passive, nil, nil, CheckpointPolicy{Interval: time.Minute}, t.TempDir(), FsyncAlways).(*server)
+	s.mu.Lock()
+	s.markReadyLocked()
+	s.mu.Unlock()
+	// Appends fail from now on
+	_ = s.wal.f.Close()
+
+	resp, ok := s.orderRequest(RequestMessage{Type: Req, ClientID: "C1", RequestNum: 1, Message: "PUT a 1"})
+	if !ok || resp.Message == kvOK {
+		t.Fatalf("reply = %q, %v, want an error reply", resp.Message, ok)
+	}
+	if got := app.Apply("GET a"); got != kvNotFound {
+		t.Errorf("GET a = %q, want the unlogged PUT not applied", got)
+	}
+	if s.isReady() || !s.stoppedServing() {
+		t.Error("replica still serving after a WAL append failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nextSeq != 1 {
+		t.Errorf("nextSeq = %d, want 1", s.nextSeq)
+	}
+	if _, ok := s.replies["C1"]; ok {
+		t.Error("the error reply went into the reply cache")
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/wenyinh/18749-project/protocol"
+)
+
+// send writes a protocol message from this replica
+func (s *server) send(conn net.Conn, seq int, msg protocol.Message) error {
+	return protocol.Send(conn, s.ReplicaId, seq, msg)
+}
+
+// decodeRequest turns a client's REQ envelope into the request the server
+// orders, logs and caches
+func decodeRequest(line string) (RequestMessage, error) {
+	env, err := protocol.Decode(line)
+	if err != nil {
+		return RequestMessage{}, err
+	}
+	var req protocol.Request
+	if err := env.Unmarshal(&req); err != nil {
+		return RequestMessage{}, err
+	}
+	return RequestMessage{Type: Req, ClientID: env.Sender, RequestNum: env.Seq, Message: req.Message}, nil
+}
+
+func encodeResponse(resp ResponseMessage) (string, error) {
+	return protocol.Encode(resp.ServerID, resp.RequestNum, protocol.Response{ClientID: resp.ClientID, Message: resp.Message})
+}
+
+// encodeCheckpoint returns the CHECKPOINT envelope for a checkpoint
+func encodeCheckpoint(ckpt CheckpointMessage) (string, error) {
+	replies := make(map[string]protocol.Reply, len(ckpt.Replies))
+	for clientID, resp := range ckpt.Replies {
+		replies[clientID] = protocol.Reply{ServerID: resp.ServerID, RequestNum: resp.RequestNum, Message: resp.Message}
+	}
+	return protocol.Encode(ckpt.ReplicaId, ckpt.CheckpointNum, protocol.Checkpoint{
+		State:   ckpt.State,
+		LastSeq: ckpt.LastSeq,
+		Replies: replies,
+		Delta:   ckpt.Delta,
+		BaseNum: ckpt.BaseNum,
+	})
+}
+
+// decodeCheckpoint parses a CHECKPOINT envelope
+func decodeCheckpoint(line string) (CheckpointMessage, error) {
+	env, err := protocol.Decode(line)
+	if err != nil {
+		return CheckpointMessage{}, err
+	}
+	var body protocol.Checkpoint
+	if err := env.Unmarshal(&body); err != nil {
+		return CheckpointMessage{}, err
+	}
+	if env.Seq < 0 {
+		return CheckpointMessage{}, fmt.Errorf("bad checkpoint number %d", env.Seq)
+	}
+	replies := make(map[string]ResponseMessage, len(body.Replies))
+	for clientID, r := range body.Replies {
+		replies[clientID] = ResponseMessage{
+			Type:       Resp,
+			ServerID:   r.ServerID,
+			ClientID:   clientID,
+			RequestNum: r.RequestNum,
+			Message:    r.Message,
+		}
+	}
+	return CheckpointMessage{
+		Type:          Checkpoint,
+		ReplicaId:     env.Sender,
+		State:         body.State,
+		CheckpointNum: env.Seq,
+		LastSeq:       body.LastSeq,
+		Replies:       replies,
+		Delta:         body.Delta,
+		BaseNum:       body.BaseNum,
+	}, nil
+}
+
+// handleHello agrees on a protocol version and capabilities with a client
+func (s *server) handleHello(conn net.Conn, line string) {
+	env, err := protocol.Decode(line)
+	var hello protocol.Hello
+	if err == nil {
+		err = env.Unmarshal(&hello)
+	}
+	if err != nil {
+		log.Printf("[SERVER][%s] bad HELLO from %s: %v", s.ReplicaId, conn.RemoteAddr(), err)
+		_ = s.send(conn, 0, protocol.Nack{Reason: err.Error()})
+		return
+	}
+	agreed, err := hello.Handshake.Agree()
+	if err != nil {
+		log.Printf("[SERVER][%s] rejected client %s: %v", s.ReplicaId, env.Sender, err)
+		_ = s.send(conn, 0, protocol.Nack{Reason: err.Error()})
+		return
+	}
+	log.Printf("[SERVER][%s] client %s speaks protocol v%d, capabilities %v",
+		s.ReplicaId, env.Sender, agreed.Version, agreed.Capabilities)
+	_ = s.send(conn, 0, protocol.Ack{Handshake: agreed})
+}
@@ -0,0 +1,290 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Framed connections carry one message per frame instead of one per line:
+//
+//	+----------------+------------+-----------+---------+
+//	| length: uint32 | tlen: byte | type      | payload |
+//	+----------------+------------+-----------+---------+
+//
+// length counts everything after itself. Plain-text commands put their
+// first word in type and the arguments in payload ("REGISTER S1" is type
+// REGISTER, payload "S1"); JSON messages put their "type" field in type and
+// the whole document in payload.
+//
+// The dialing side offers framing with a FRAMING v1 line. A peer that
+// understands it answers FRAMING OK and both switch to frames; any other
+// reply (an old peer's error) keeps lines. Without a reply within the timeout
+// the peer may still switch later, so Dial drops that connection and dials
+// again without offering framing.
+const (
+	FramingHello = "FRAMING v1"
+	FramingOK    = "FRAMING OK"
+	// MaxFrameSize bounds a single frame so a corrupt length cannot exhaust memory
+	MaxFrameSize = 64 << 20
+	// NegotiateTimeout is how long a dialer waits for FRAMING OK by default
+	NegotiateTimeout = time.Second
+)
+
+// Framing makes Dial offer framed connections. Line-based peers keep working.
+var Framing = false
+
+// Message is one protocol message with its type made explicit
+type Message struct {
+	Type    string
+	Payload string
+}
+
+// ParseLine splits a line-protocol message into type and payload
+func ParseLine(line string) Message {
+	if strings.HasPrefix(line, "{") {
+		var mt struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal([]byte(line), &mt); err == nil {
+			return Message{Type: mt.Type, Payload: line}
+		}
+	}
+	typ, payload, _ := strings.Cut(line, " ")
+	return Message{Type: typ, Payload: payload}
+}
+
+// IsJSON reports whether the payload is a JSON document
+func (m Message) IsJSON() bool {
+	return strings.HasPrefix(m.Payload, "{")
+}
+
+// String returns the message in line-protocol form
+func (m Message) String() string {
+	switch {
+	case m.Type == "" || m.IsJSON():
+		return m.Payload
+	case m.Payload == "":
+		return m.Type
+	default:
+		return m.Type + " " + m.Payload
+	}
+}
+
+// Conn is a connection after framing negotiation. It reads and writes
+// newline-terminated lines either way, so WriteLine and ReadLine work on it
+// unchanged; ReadMessage additionally returns each message with its type.
+// Use either ReadMessage or a bufio.Reader on the Conn, not both.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	framed bool
+	rbuf   []byte // Line-form bytes not yet returned by Read
+	wmu    sync.Mutex
+	wbuf   []byte // Framed: written bytes not yet ending in a newline
+}
+
+// Framed reports whether the peer agreed to framing
+func (c *Conn) Framed() bool {
+	return c.framed
+}
+
+// ReadMessage returns the next message
+func (c *Conn) ReadMessage() (Message, error) {
+	if c.framed && len(c.rbuf) == 0 {
+		return c.readFrame()
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return Message{}, err
+	}
+	return ParseLine(line), nil
+}
+
+func (c *Conn) readLine() (string, error) {
+	if i := bytes.IndexByte(c.rbuf, '\n'); i >= 0 {
+		line := string(c.rbuf[:i])
+		c.rbuf = c.rbuf[i+1:]
+		return strings.TrimRight(line, "\r"), nil
+	}
+	if c.framed {
+		msg, err := c.readFrame()
+		if err != nil {
+			return "", err
+		}
+		line := string(c.rbuf) + msg.String()
+		c.rbuf = nil
+		return line, nil
+	}
+	rest, err := ReadLine(c.r)
+	if err != nil {
+		return "", err
+	}
+	line := string(c.rbuf) + rest
+	c.rbuf = nil
+	return line, nil
+}
+
+func (c *Conn) readFrame() (Message, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return Message{}, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	tlen := uint32(hdr[4])
+	if n < 1+tlen || n > MaxFrameSize {
+		return Message{}, fmt.Errorf("bad frame length %d", n)
+	}
+	body := make([]byte, n-1)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return Message{}, err
+	}
+	return Message{Type: string(body[:tlen]), Payload: string(body[tlen:])}, nil
+}
+
+// Read returns the connection's messages as newline-terminated lines
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		if !c.framed {
+			return c.r.Read(p)
+		}
+		msg, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf = []byte(msg.String() + "\n")
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write sends newline-terminated lines, one frame per line when framed
+func (c *Conn) Write(p []byte) (int, error) {
+	if !c.framed {
+		return c.Conn.Write(p)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = append(c.wbuf, p...)
+	var out []byte
+	for {
+		i := bytes.IndexByte(c.wbuf, '\n')
+		if i < 0 {
+			break
+		}
+		frame, err := encodeFrame(ParseLine(strings.TrimRight(string(c.wbuf[:i]), "\r")))
+		if err != nil {
+			return 0, err
+		}
+		out = append(out, frame...)
+		c.wbuf = c.wbuf[i+1:]
+	}
+	if len(out) > 0 {
+		// One write per call keeps concurrent WriteLine calls from interleaving
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// WriteMessage sends one message
+func (c *Conn) WriteMessage(m Message) error {
+	if !c.framed {
+		return WriteLine(c, m.String())
+	}
+	frame, err := encodeFrame(m)
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err = c.Conn.Write(frame)
+	return err
+}
+
+func encodeFrame(m Message) ([]byte, error) {
+	if len(m.Type) > 255 {
+		return nil, fmt.Errorf("message type too long: %d bytes", len(m.Type))
+	}
+	n := 1 + len(m.Type) + len(m.Payload)
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("message too large: %d bytes", n)
+	}
+	buf := make([]byte, 4+n)
+	binary.BigEndian.PutUint32(buf[:4], uint32(n))
+	buf[4] = byte(len(m.Type))
+	copy(buf[5:], m.Type)
+	copy(buf[5+len(m.Type):], m.Payload)
+	return buf, nil
+}
+
+// Accept negotiates the codec on an accepted connection. A peer that opens
+// with FRAMING v1 gets framing; for any other peer the first line is kept
+// and read back as its first message.
+func Accept(conn net.Conn) (*Conn, error) {
+	c := &Conn{Conn: conn, r: bufio.NewReader(conn)}
+	line, err := ReadLine(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if line != FramingHello {
+		c.rbuf = []byte(line + "\n")
+		return c, nil
+	}
+	if err := WriteLine(conn, FramingOK); err != nil {
+		return nil, err
+	}
+	c.framed = true
+	return c, nil
+}
+
+// Negotiate offers framing on a dialed connection and waits up to timeout
+// for the peer to accept; any other reply keeps the connection line-based.
+// Without a reply it closes the connection: a late FRAMING OK would leave the
+// two sides on different codecs.
+func Negotiate(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	c := &Conn{Conn: conn, r: bufio.NewReader(conn)}
+	if timeout <= 0 {
+		timeout = NegotiateTimeout
+	}
+	if err := WriteLine(conn, FramingHello); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	reply, err := ReadLine(c.r)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("no reply to %s: %w", FramingHello, err)
+	}
+	c.framed = reply == FramingOK
+	return c, nil
+}
+
+// Dial connects to addr and, when Framing is set, offers framing. A peer
+// that does not answer the offer is dialed again with plain lines. A zero
+// timeout dials without one and negotiates within NegotiateTimeout.
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if !Framing {
+		return conn, nil
+	}
+	c, err := Negotiate(conn, timeout)
+	if err != nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	return c, nil
+}
@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptAsync runs Accept on the server end of a pipe
+func acceptAsync(conn net.Conn) <-chan *Conn {
+	ch := make(chan *Conn, 1)
+	go func() {
+		c, err := Accept(conn)
+		if err != nil {
+			c = nil
+		}
+		ch <- c
+	}()
+	return ch
+}
+
+func closeOnCleanup(t *testing.T, conns ...net.Conn) {
+	t.Cleanup(func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	})
+}
+
+func TestNegotiateFramedPeers(t *testing.T) {
+	client, server := net.Pipe()
+	closeOnCleanup(t, client, server)
+	accepted := acceptAsync(server)
+	dialer, err := Negotiate(client, time.Second)
+	if err != nil {
+		t.Fatalf("Negotiate: %v", err)
+	}
+	acceptor := <-accepted
+	if acceptor == nil {
+		t.Fatal("Accept failed")
+	}
+	if !dialer.Framed() || !acceptor.Framed() {
+		t.Fatalf("Framed() = %v (dialer), %v (acceptor), want both true", dialer.Framed(), acceptor.Framed())
+	}
+
+	// A line split across writes still becomes one frame
+	go func() {
+		_, _ = dialer.Write([]byte("REGISTER "))
+		_, _ = dialer.Write([]byte("S1\nPING\n"))
+		_ = dialer.WriteMessage(Message{Type: "ADD", Payload: `{"type":"ADD","server_id":"S1"}`})
+	}()
+	want := []Message{
+		{Type: "REGISTER", Payload: "S1"},
+		{Type: "PING"},
+		{Type: "ADD", Payload: `{"type":"ADD","server_id":"S1"}`},
+	}
+	for _, w := range want {
+		got, err := acceptor.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if got != w {
+			t.Errorf("ReadMessage = %+v, want %+v", got, w)
+		}
+	}
+
+	// Frames read back as lines through a bufio.Reader
+	go func() {
+		_ = WriteLine(acceptor, "PONG")
+	}()
+	line, err := ReadLine(bufio.NewReader(dialer))
+	if err != nil || line != "PONG" {
+		t.Errorf("ReadLine = %q, %v, want PONG", line, err)
+	}
+}
+
+func TestAcceptLinePeer(t *testing.T) {
+	client, server := net.Pipe()
+	closeOnCleanup(t, client, server)
+	accepted := acceptAsync(server)
+	go func() {
+		_ = WriteLine(client, "REGISTER S1")
+		_ = WriteLine(client, "PING")
+	}()
+	acceptor := <-accepted
+	if acceptor == nil {
+		t.Fatal("Accept failed")
+	}
+	if acceptor.Framed() {
+		t.Fatal("Framed() = true for a line-based peer")
+	}
+	// The line Accept looked at is not lost
+	got, err := acceptor.ReadMessage()
+	if err != nil || got != (Message{Type: "REGISTER", Payload: "S1"}) {
+		t.Errorf("first ReadMessage = %+v, %v, want REGISTER S1", got, err)
+	}
+	got, err = acceptor.ReadMessage()
+	if err != nil || got != (Message{Type: "PING"}) {
+		t.Errorf("second ReadMessage = %+v, %v, want PING", got, err)
+	}
+
+	go func() {
+		_ = WriteLine(acceptor, "PONG")
+	}()
+	line, err := ReadLine(bufio.NewReader(client))
+	if err != nil || line != "PONG" {
+		t.Errorf("line peer read %q, %v, want PONG", line, err)
+	}
+}
+
+func TestAcceptLinePeerThroughReader(t *testing.T) {
+	client, server := net.Pipe()
+	closeOnCleanup(t, client, server)
+	accepted := acceptAsync(server)
+	go func() {
+		_, _ = client.Write([]byte("GET a\nGET b\n"))
+	}()
+	acceptor := <-accepted
+	if acceptor == nil {
+		t.Fatal("Accept failed")
+	}
+	r := bufio.NewReader(acceptor)
+	for _, want := range []string{"GET a", "GET b"} {
+		line, err := ReadLine(r)
+		if err != nil || line != want {
+			t.Errorf("ReadLine = %q, %v, want %q", line, err, want)
+		}
+	}
+}
+
+func TestNegotiateLinePeer(t *testing.T) {
+	client, server := net.Pipe()
+	closeOnCleanup(t, client, server)
+	r := bufio.NewReader(server)
+	go func() {
+		if _, err := ReadLine(r); err != nil {
+			return
+		}
+		_ = WriteLine(server, "ERROR: unknown command FRAMING")
+	}()
+	dialer, err := Negotiate(client, time.Second)
+	if err != nil {
+		t.Fatalf("Negotiate: %v", err)
+	}
+	if dialer.Framed() {
+		t.Fatal("Framed() = true for a line-based peer")
+	}
+	// The connection keeps working as plain lines
+	go func() {
+		_ = WriteLine(dialer, "PING")
+	}()
+	line, err := ReadLine(r)
+	if err != nil || line != "PING" {
+		t.Errorf("peer read %q, %v, want PING", line, err)
+	}
+}
+
+func TestNegotiateSilentPeer(t *testing.T) {
+	client, server := net.Pipe()
+	closeOnCleanup(t, client, server)
+	// The peer reads the offer, never answers and then waits for more
+	next := make(chan error, 1)
+	go func() {
+		r := bufio.NewReader(server)
+		if _, err := ReadLine(r); err != nil {
+			next <- err
+			return
+		}
+		_, err := r.ReadByte()
+		next <- err
+	}()
+	if _, err := Negotiate(client, 50*time.Millisecond); err == nil {
+		t.Fatal("Negotiate succeeded without a reply")
+	}
+	// The connection is not reused
+	if err := <-next; err == nil {
+		t.Error("connection still open after a failed negotiation")
+	}
+}
+
+func TestDialAfterLateFramingOK(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	framing := Framing
+	Framing = true
+	t.Cleanup(func() {
+		Framing = framing
+	})
+
+	// The first connection's peer accepts framing after the dialer gave up;
+	// the second one is served as usual
+	lines := make(chan string, 1)
+	go func() {
+		slow, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer slow.Close()
+		r := bufio.NewReader(slow)
+		if _, err := ReadLine(r); err != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+		_ = WriteLine(slow, FramingOK)
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c, err := Accept(conn)
+		if err != nil {
+			return
+		}
+		if c.Framed() {
+			lines <- "framed"
+			return
+		}
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		lines <- msg.String()
+	}()
+
+	conn, err := Dial(ln.Addr().String(), 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	closeOnCleanup(t, conn)
+	if c, ok := conn.(*Conn); ok && c.Framed() {
+		t.Fatal("dialer switched to frames after the negotiation timed out")
+	}
+	if err := WriteLine(conn, "PING"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-lines:
+		if line != "PING" {
+			t.Errorf("peer read %q, want PING on a fresh line-based connection", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer never read from the redialed connection")
+	}
+}
+
+func TestReadFrameRejectsBadLength(t *testing.T) {
+	tests := []struct {
+		name string
+		n    uint32
+		tlen byte
+	}{
+		{"type longer than frame", 3, 5},
+		{"too large", MaxFrameSize + 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			closeOnCleanup(t, client, server)
+			c := &Conn{Conn: server, r: bufio.NewReader(server), framed: true}
+			go func() {
+				var hdr [5]byte
+				binary.BigEndian.PutUint32(hdr[:4], tt.n)
+				hdr[4] = tt.tlen
+				_, _ = client.Write(hdr[:])
+			}()
+			if _, err := c.ReadMessage(); err == nil {
+				t.Errorf("ReadMessage accepted frame length %d with type length %d", tt.n, tt.tlen)
+			}
+		})
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	tests := []struct {
+		line string
+		want Message
+	}{
+		{"PING", Message{Type: "PING"}},
+		{"REGISTER S1 S2", Message{Type: "REGISTER", Payload: "S1 S2"}},
+		{`{"type":"ACK"}`, Message{Type: "ACK", Payload: `{"type":"ACK"}`}},
+	}
+	for _, tt := range tests {
+		got := ParseLine(tt.line)
+		if got != tt.want {
+			t.Errorf("ParseLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+		if s := got.String(); s != tt.line {
+			t.Errorf("%+v.String() = %q, want %q", got, s, tt.line)
+		}
+	}
+}